@@ -5,33 +5,82 @@ import (
 	"any-oidc-proxy/pkg/backend/metabase"
 	"any-oidc-proxy/pkg/backend/nocodb"
 	"any-oidc-proxy/pkg/backend/plane"
+	"any-oidc-proxy/pkg/logging"
+	"any-oidc-proxy/pkg/metrics"
 	oidcauth "any-oidc-proxy/pkg/oidc"
+	"any-oidc-proxy/pkg/store"
+	"any-oidc-proxy/pkg/tracing"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 type App struct {
-	oidcAuth      *oidcauth.OIDCAuthenticator
+	providers     []*oidcauth.OIDCAuthenticator
 	backend       backend.Backend
 	cookieManager backend.CookieManager
+	proxySessions *oidcauth.ProxySessions
+	relogins      *reloginGroup // nil — повторный вход в бэкенд выключен
 	config        *Config
+	tracer        *sdktrace.TracerProvider // nil — трассировка выключена
 }
 
-func getBackend(cfg *Config) (backend.Backend, error) {
+func getStore(cfg *Config) (store.Store, error) {
+	if cfg.StorePath == "" {
+		return store.NewMemoryStore(), nil
+	}
+	if cfg.StorePath == "memory" {
+		log.Warn("STORE_PATH=memory: backend passwords and identity links are lost on restart and not shared between replicas")
+		return store.NewMemoryStore(), nil
+	}
+	return store.NewBoltStore(cfg.StorePath)
+}
+
+func getBackend(cfg *Config, localStore store.Store) (backend.Backend, error) {
+	roles, err := backend.ParseRoleMapping(cfg.RoleMapping)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := backend.NewCredentials(
+		localStore,
+		cfg.CredentialSecret,
+		cfg.CredentialRotateInterval,
+		func() string { return oidcauth.GenPassword(24) },
+	)
+	if err != nil {
+		return nil, err
+	}
+	opts := backend.Options{
+		Roles:         roles,
+		SessionCookie: cfg.MetabaseSessionCookieName,
+		Credentials:   credentials,
+		Protection:    backend.NewProtection(cfg.ProtectedAccounts, cfg.ProtectedAccountsGroup),
+		Identities:    backend.NewStoreIdentities(localStore, cfg.Type),
+	}
+	// Запросы к API бэкенда попадают в трассу логина
+	httpClient := &http.Client{
+		Timeout:   cfg.HTTPRequestTimeoutBackend,
+		Transport: logging.Transport(tracing.Transport(http.DefaultTransport)),
+	}
+
 	switch cfg.Type {
 	case "metabase":
 		mbBackend, err := metabase.NewMetabaseBackend(
 			cfg.ProxyURL,
 			cfg.MetabaseAdminEmail,
 			cfg.MetabaseAdminPassword,
-			&http.Client{Timeout: cfg.HTTPRequestTimeoutBackend},
+			httpClient,
+			opts,
 		)
 		if err != nil {
 			return nil, err
@@ -42,17 +91,22 @@ func getBackend(cfg *Config) (backend.Backend, error) {
 			cfg.ProxyURL,
 			cfg.NocodbAdminEmail,
 			cfg.NocodbAdminPassword,
-			&http.Client{Timeout: cfg.HTTPRequestTimeoutBackend},
+			cfg.NocodbDefaultRole,
+			httpClient,
+			opts,
 		)
 		if err != nil {
 			return nil, err
 		}
 		return mbBackend, nil
+	case "none":
+		return backend.NoopBackend{}, nil
 	case "plane":
 		mbBackend, err := plane.NewPlaneBackend(
 			cfg.ProxyURL,
 			cfg.PlaneDSN,
-			&http.Client{Timeout: cfg.HTTPRequestTimeoutBackend},
+			httpClient,
+			opts,
 		)
 		if err != nil {
 			return nil, err
@@ -63,40 +117,191 @@ func getBackend(cfg *Config) (backend.Backend, error) {
 	}
 }
 
-func newApp(cfg *Config) (*App, error) {
-	mbBackend, err := getBackend(cfg)
-	// Менеджер куков
-	cookieManager := backend.NewSimpleCookieManager(cfg.SecureCookies, cfg.MetabaseSessionCookieName)
+// sessionCookieNames возвращает куки сессии бэкенда, которые удаляются при выходе.
+func sessionCookieNames(cfg *Config) []string {
+	switch cfg.Type {
+	case "nocodb":
+		return []string{nocodb.RefreshCookieName}
+	case "plane":
+		return []string{plane.SessionCookieName, "csrftoken"}
+	case "none":
+		return nil
+	default:
+		return []string{cfg.MetabaseSessionCookieName}
+	}
+}
+
+func getStateStore(cfg *Config) (oidcauth.StateStore, error) {
+	switch cfg.StateStore {
+	case "postgres":
+		return oidcauth.NewPostgresStateStore(cfg.StateStoreDSN)
+	default:
+		return oidcauth.NewMemoryStateStore(), nil
+	}
+}
 
-	// OIDC аутентификатор
-	redirectURL, err := url.JoinPath(cfg.ExternalURL, cfg.OIDCPath, "callback")
+// getSessionRegistry выбирает реестр сессий для back-channel logout; он живёт там же, где state.
+func getSessionRegistry(cfg *Config) (oidcauth.SessionRegistry, error) {
+	if !cfg.BackchannelLogout {
+		return nil, nil
+	}
+	switch cfg.StateStore {
+	case "postgres":
+		return oidcauth.NewPostgresSessionRegistry(cfg.StateStoreDSN)
+	default:
+		return oidcauth.NewMemorySessionRegistry(), nil
+	}
+}
+
+func newAuthenticator(
+	cfg *Config,
+	p ProviderConfig,
+	stateStore oidcauth.StateStore,
+	sessions oidcauth.SessionRegistry,
+	proxySessions *oidcauth.ProxySessions,
+	userLocks *oidcauth.UserLocks,
+	mbBackend backend.Backend,
+	cookieManager backend.CookieManager,
+) (*oidcauth.OIDCAuthenticator, error) {
+	redirectURL, err := url.JoinPath(cfg.ExternalURL, p.CallbackPath)
 	if err != nil {
 		return nil, err
 	}
 
+	var policy *oidcauth.AccessPolicy
+	if p.AccessPolicy != "" {
+		policy, err = oidcauth.NewAccessPolicy(p.AccessPolicy, cfg.AccessPolicyLists)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	oidcConfig := oidcauth.Config{
-		IssuerURL:      cfg.OIDCIssuer,
-		ClientID:       cfg.OIDCClientID,
-		ClientSecret:   cfg.OIDCClientSecret,
+		Name:           p.Name,
+		DisplayName:    p.DisplayName,
+		IssuerURL:      p.Issuer,
+		ClientID:       p.ClientID,
+		ClientSecret:   p.ClientSecret,
 		RedirectURL:    redirectURL,
-		Scopes:         cfg.OIDCScope,
+		ExternalURL:    cfg.ExternalURL,
+		Scopes:         p.Scope,
 		StateSecret:    cfg.StateSecret,
 		StateTTL:       cfg.StateTTL,
-		AllowedDomains: cfg.AllowedEmailDomains,
-		AllowedEmails:  cfg.AllowedEmails,
+		StateStore:     stateStore,
+		AllowedDomains: p.AllowedEmailDomains,
+		AllowedEmails:  p.AllowedEmails,
+		AllowedGroups:  p.AllowedGroups,
+		Policy:         policy,
+		RedirectHosts:  cfg.AllowedRedirectHosts,
+		PKCE:           p.PKCE,
+		SecureCookies:  cfg.SecureCookies,
+		UserInfoMode:   p.UserInfo,
+		Claims: oidcauth.ClaimMapping{
+			Subject:   p.ClaimSubject,
+			Email:     p.ClaimEmail,
+			FirstName: p.ClaimFirstName,
+			LastName:  p.ClaimLastName,
+			Name:      p.ClaimName,
+			Groups:    p.ClaimGroups,
+			NameOrder: p.NameOrder,
+		},
+		RequireEmailVerified: p.RequireEmailVerified,
+		EmailVerifiedExempt:  p.EmailVerifiedExemptDomains,
+		PostLogoutURL:        cfg.OIDCPostLogoutURL,
+		RPLogout:             cfg.OIDCRPLogout,
+		LogoutBackend:        cfg.LogoutBackendSession,
+		Sessions:             sessions,
+		SessionTTL:           cfg.BackchannelSessionTTL,
+		ProxySessions:        proxySessions,
+		UserLocks:            userLocks,
+		DefaultFirstName:     cfg.DefaultUserFirstName,
+		DefaultLastName:      cfg.DefaultUserLastName,
 	}
 
-	oidcAuth, err := oidcauth.NewOIDCAuthenticator(oidcConfig, mbBackend, cookieManager)
+	return oidcauth.NewOIDCAuthenticator(oidcConfig, mbBackend, cookieManager)
+}
+
+func newApp(cfg *Config) (*App, error) {
+	localStore, err := getStore(cfg)
 	if err != nil {
 		return nil, err
 	}
+	mbBackend, err := getBackend(cfg, localStore)
+	if err != nil {
+		return nil, err
+	}
+	metrics.SetBackend(cfg.Type)
+	// Менеджер куков
+	cookieManager := backend.NewSimpleCookieManager(cfg.SecureCookies, sessionCookieNames(cfg)...)
+
+	stateStore, err := getStateStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := getSessionRegistry(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// Собственная сессия прокси, нужна для SESSION_ENFORCE и forward auth
+	var proxySessions *oidcauth.ProxySessions
+	if cfg.SessionEnforce || cfg.ForwardAuth {
+		proxySessions, err = oidcauth.NewProxySessions(
+			cfg.SessionSecret,
+			cfg.SessionCookieName,
+			cfg.SessionCookieDomain,
+			cfg.SessionTTL,
+			cfg.SecureCookies,
+			sessions,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Блокировки по email общие для всех провайдеров: вход одного человека через разных провайдеров
+	// тоже сериализуется
+	userLocks := oidcauth.NewUserLocks()
+
+	// OIDC аутентификаторы, по одному на провайдера
+	providers := make([]*oidcauth.OIDCAuthenticator, 0, len(cfg.Providers))
+	for _, p := range cfg.Providers {
+		oidcAuth, err := newAuthenticator(cfg, p, stateStore, sessions, proxySessions, userLocks, mbBackend, cookieManager)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %w", p.Name, err)
+		}
+		providers = append(providers, oidcAuth)
+	}
 
-	return &App{
-		oidcAuth:      oidcAuth,
+	app := &App{
+		providers:     providers,
 		backend:       mbBackend,
 		cookieManager: cookieManager,
+		proxySessions: proxySessions,
 		config:        cfg,
-	}, nil
+	}
+	if cfg.TracingEnabled {
+		exporter, err := tracing.NewExporter(context.Background(), cfg.TracingExporter)
+		if err != nil {
+			return nil, fmt.Errorf("tracing exporter: %w", err)
+		}
+		if app.tracer, err = tracing.Init(exporter, cfg.TracingServiceName); err != nil {
+			return nil, fmt.Errorf("tracing: %w", err)
+		}
+	}
+	// Повторный вход в бэкенд возможен только по сессии прокси
+	if proxySessions != nil && cfg.BackendRelogin {
+		app.relogins = newReloginGroup()
+	}
+	return app, nil
+}
+
+func (a *App) provider(name string) *oidcauth.OIDCAuthenticator {
+	for _, p := range a.providers {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
 }
 
 func (a *App) handleOIDC(w http.ResponseWriter, r *http.Request) {
@@ -108,38 +313,157 @@ func (a *App) handleOIDC(w http.ResponseWriter, r *http.Request) {
 		redirect = "/"
 	}
 
-	if err := a.oidcAuth.StartAuth(w, r, redirect); err != nil {
+	name := r.URL.Query().Get("provider")
+	if name == "" && len(a.providers) == 1 {
+		name = a.providers[0].Name()
+	}
+	if name == "" {
+		a.renderChooser(w, r, redirect)
+		return
+	}
+
+	oidcAuth := a.provider(name)
+	if oidcAuth == nil {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+	if err := oidcAuth.StartAuth(w, r, redirect); err != nil {
+		logging.FromContext(r.Context()).Errorf("OIDC start error (%s): %v", oidcAuth.Name(), err)
 		http.Error(w, "Authentication failed", http.StatusInternalServerError)
 	}
 }
 
-func (a *App) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
-	if err := a.oidcAuth.HandleCallback(w, r); err != nil {
-		log.Printf("OIDC callback error: %v", err)
-		http.Error(w, "Authentication failed", http.StatusInternalServerError)
+func (a *App) handleOIDCCallback(oidcAuth *oidcauth.OIDCAuthenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := oidcAuth.HandleCallback(w, r); err != nil {
+			logging.FromContext(r.Context()).Errorf("OIDC callback error (%s): %v", oidcAuth.Name(), err)
+			if errors.Is(err, backend.ErrProtectedAccount) {
+				http.Error(w, "SSO login to this account is not allowed", http.StatusForbidden)
+				return
+			}
+			http.Error(w, "Authentication failed", http.StatusInternalServerError)
+		}
+	}
+}
+
+func (a *App) handleBackchannelLogout(oidcAuth *oidcauth.OIDCAuthenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := oidcAuth.BackchannelLogout(w, r); err != nil {
+			logging.FromContext(r.Context()).Warnf("OIDC back-channel logout error (%s): %v", oidcAuth.Name(), err)
+			w.Header().Set("Cache-Control", "no-store")
+			http.Error(w, "Logout failed", http.StatusBadRequest)
+		}
+	}
+}
+
+// handleLogout завершает сессию через провайдера, под которым вошёл пользователь.
+func (a *App) handleLogout(w http.ResponseWriter, r *http.Request) {
+	oidcAuth := a.providers[0]
+	if c, err := r.Cookie(oidcauth.ProviderCookieName); err == nil {
+		if p := a.provider(c.Value); p != nil {
+			oidcAuth = p
+		}
+	}
+	if err := oidcAuth.Logout(w, r); err != nil {
+		if errors.Is(err, oidcauth.ErrCrossSiteLogout) {
+			logging.FromContext(r.Context()).Warnf("OIDC logout rejected: %v", err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		logging.FromContext(r.Context()).Errorf("OIDC logout error: %v", err)
+		http.Error(w, "Logout failed", http.StatusInternalServerError)
+	}
+}
+
+// requireSession пропускает к бэкенду только запросы с действующей сессией прокси.
+// Переходы браузера отправляются на логин, остальные запросы получают 401.
+func (a *App) requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range a.config.SessionExemptPaths {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if _, err := a.proxySessions.Verify(r); err == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if isNavigation(r) {
+			http.Redirect(w, r, a.loginURL(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// redirectLoginPage отправляет на SSO переходы на собственную страницу входа бэкенда.
+func (a *App) redirectLoginPage(next http.Handler) http.Handler {
+	detector, ok := a.backend.(backend.LoginPageDetector)
+	if !ok {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isNavigation(r) {
+			if rd, login := detector.LoginRedirect(r); login {
+				http.Redirect(w, r, a.loginURL(rd), http.StatusFound)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loginURL — адрес входа через OIDC с возвратом на rd.
+func (a *App) loginURL(rd string) string {
+	return a.config.OIDCPath + "?rd=" + url.QueryEscape(rd)
+}
+
+// isNavigation отличает переход на страницу от XHR/fetch и запросов ресурсов.
+func isNavigation(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
 	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
 }
 
 func (a *App) routes() http.Handler {
 	mux := http.NewServeMux()
 	startPath := a.config.OIDCPath
-	callbackPath := strings.TrimSuffix(a.config.OIDCPath, "/") + "/callback"
 	proxyURL, err := url.Parse(a.config.ProxyURL)
 	if err != nil {
-		log.Warnf("PROXY_URL parse: %w", err)
+		log.Warnf("PROXY_URL parse: %v", err)
 		return nil
 	}
 
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		io.WriteString(w, "ok")
 	})
+	if a.config.MetricsEnabled && a.config.MetricsAddr == "" {
+		mux.Handle(a.config.MetricsPath, metrics.Handler())
+	}
 
-	// OIDC entry and callback
+	// OIDC entry (provider chooser) and per-provider callbacks
 	mux.HandleFunc(startPath, a.handleOIDC)
-	mux.HandleFunc(callbackPath, a.handleOIDCCallback)
+	for _, p := range a.config.Providers {
+		mux.HandleFunc(p.CallbackPath, a.handleOIDCCallback(a.provider(p.Name)))
+		if a.config.BackchannelLogout {
+			mux.HandleFunc(p.BackchannelPath, a.handleBackchannelLogout(a.provider(p.Name)))
+		}
+	}
+	mux.HandleFunc(startPath+"logout", a.handleLogout)
+	if a.config.ForwardAuth {
+		mux.HandleFunc(a.config.ForwardAuthPath, a.handleForwardAuth)
+	}
 
 	// Reverse proxy
 	proxy := httputil.NewSingleHostReverseProxy(proxyURL)
+	transport := metrics.InstrumentTransport(proxyURL.Host, tracing.Transport(http.DefaultTransport))
+	proxy.Transport = transport
 	origDirector := proxy.Director
 	proxy.Director = func(r *http.Request) {
 		origDirector(r)
@@ -163,28 +487,65 @@ func (a *App) routes() http.Handler {
 			}
 		}
 	}
-	if a.config.ProxyRewriteLocationHeader {
-		proxy.ModifyResponse = func(resp *http.Response) error {
-			loc := resp.Header.Get("Location")
-			if loc == "" {
-				return nil
-			}
-			if strings.HasPrefix(loc, a.config.ProxyURL) {
-				newLoc := a.config.ExternalURL + strings.TrimPrefix(loc, a.config.ProxyURL)
-				resp.Header.Set("Location", newLoc)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// Истёкшая сессия бэкенда восстанавливается без похода к IdP
+		if a.relogins != nil && a.relogin(resp, transport) {
+			return nil
+		}
+
+		// 401 на переход браузера — пользователь увидел бы ошибку или форму входа бэкенда
+		if a.config.SSOAutoRedirect && resp.StatusCode == http.StatusUnauthorized && isNavigation(resp.Request) {
+			resp.Body.Close()
+			resp.Body = http.NoBody
+			resp.ContentLength = 0
+			// Set-Cookie и прочие заголовки бэкенда сохраняются, убирается только описание тела
+			for name := range resp.Header {
+				if strings.HasPrefix(name, "Content-") {
+					resp.Header.Del(name)
+				}
 			}
+			resp.Header.Del("Www-Authenticate")
+			resp.Header.Set("Location", a.loginURL(resp.Request.URL.RequestURI()))
+			resp.StatusCode = http.StatusFound
+			resp.Status = http.StatusText(http.StatusFound)
+			return nil
+		}
+
+		if !a.config.ProxyRewriteLocationHeader {
+			return nil
+		}
+		loc := resp.Header.Get("Location")
+		if loc == "" {
 			return nil
 		}
+		if strings.HasPrefix(loc, a.config.ProxyURL) {
+			newLoc := a.config.ExternalURL + strings.TrimPrefix(loc, a.config.ProxyURL)
+			resp.Header.Set("Location", newLoc)
+		}
+		return nil
 	}
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, e error) {
-		log.Printf("proxy error: %v", e)
+		logging.FromContext(r.Context()).Errorf("proxy error: %v", e)
 		http.Error(w, "Upstream error", http.StatusBadGateway)
 	}
 
+	// TYPE=none: только аутентификация, проксировать некуда
+	if a.config.Type == "none" {
+		mux.Handle("/", http.NotFoundHandler())
+		return mux
+	}
+
 	// everything else -> proxy
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	var upstream http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		proxy.ServeHTTP(w, r)
 	})
+	if a.config.SSOAutoRedirect {
+		upstream = a.redirectLoginPage(upstream)
+	}
+	if a.config.SessionEnforce {
+		upstream = a.requireSession(upstream)
+	}
+	mux.Handle("/", upstream)
 
 	return mux
 }
@@ -197,13 +558,44 @@ func (a *App) Start() {
 		WriteTimeout: a.config.HTTPWriteTimeout,
 	}
 
-	log.Printf(
+	log.Infof(
 		"Listening on %s; proxy -> %s; OIDC path: %s",
 		a.config.ListenAddr,
 		a.config.ProxyURL,
 		a.config.OIDCPath,
 	)
-	if err := s.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+	if a.config.MetricsEnabled && a.config.MetricsAddr != "" {
+		go a.serveMetrics()
+	}
+	// Request ID проставляется до маршрутизации, чтобы попасть во все логи запроса
+	s.Handler = logging.Middleware(s.Handler)
+	if a.tracer != nil {
+		s.Handler = tracing.Handler(s.Handler)
+	}
+	err := s.ListenAndServe()
+	if a.tracer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := a.tracer.Shutdown(ctx); err != nil {
+			log.Warnf("tracing shutdown: %v", err)
+		}
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("server error: %v", err)
 	}
 }
+
+// serveMetrics отдаёт метрики на отдельном METRICS_ADDR, чтобы не открывать их вместе с прокси.
+func (a *App) serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle(a.config.MetricsPath, metrics.Handler())
+	s := &http.Server{
+		Addr:        a.config.MetricsAddr,
+		Handler:     mux,
+		ReadTimeout: a.config.HTTPReadTimeout,
+	}
+	log.Infof("Metrics listening on %s%s", a.config.MetricsAddr, a.config.MetricsPath)
+	if err := s.ListenAndServe(); err != nil {
+		log.Errorf("metrics server error: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"any-oidc-proxy/pkg/logging"
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+var chooserTemplate = template.Must(template.New("chooser").Parse(`<!DOCTYPE html>
+<html lang="ru">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Вход</title>
+<style>
+body { font-family: system-ui, sans-serif; display: flex; justify-content: center; margin-top: 15vh; background: #f6f7f9; }
+main { background: #fff; padding: 2rem 2.5rem; border-radius: 8px; box-shadow: 0 1px 4px rgba(0,0,0,.1); min-width: 280px; }
+h1 { font-size: 1.25rem; margin: 0 0 1.25rem; }
+a { display: block; padding: .75rem 1rem; margin-bottom: .5rem; border: 1px solid #d0d5dd; border-radius: 6px; color: #1d2939; text-decoration: none; }
+a:hover { background: #f2f4f7; }
+</style>
+</head>
+<body>
+<main>
+<h1>Выберите способ входа</h1>
+{{range .}}<a href="{{.URL}}">{{.Name}}</a>
+{{end}}</main>
+</body>
+</html>
+`))
+
+type chooserItem struct {
+	Name string
+	URL  string
+}
+
+// renderChooser показывает страницу выбора провайдера; ссылки ведут обратно на OIDC_PATH с ?provider=.
+func (a *App) renderChooser(w http.ResponseWriter, r *http.Request, redirect string) {
+	items := make([]chooserItem, 0, len(a.providers))
+	for _, p := range a.providers {
+		q := url.Values{}
+		q.Set("provider", p.Name())
+		q.Set("rd", redirect)
+		items = append(items, chooserItem{
+			Name: p.DisplayName(),
+			URL:  a.config.OIDCPath + "?" + q.Encode(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := chooserTemplate.Execute(w, items); err != nil {
+		logging.FromContext(r.Context()).Errorf("provider chooser render error: %v", err)
+	}
+}
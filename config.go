@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -19,6 +20,7 @@ type Config struct {
 	// Nocodb
 	NocodbAdminEmail    string
 	NocodbAdminPassword string
+	NocodbDefaultRole   string
 	// Plane
 	PlaneDSN string
 	// OIDC
@@ -28,20 +30,95 @@ type Config struct {
 	OIDCPath                   string
 	OIDCScope                  []string
 	OIDCPrompt                 string
+	OIDCPKCE                   bool
+	OIDCPostLogoutURL          string
+	OIDCRPLogout               bool
+	LogoutBackendSession       bool
+	BackchannelLogout          bool
+	BackchannelSessionTTL      time.Duration
+	SessionEnforce             bool
+	SessionSecret              string
+	SessionCookieName          string
+	SessionCookieDomain        string
+	SessionTTL                 time.Duration
+	SessionExemptPaths         []string
+	ForwardAuth                bool
+	ForwardAuthPath            string
+	OIDCUserInfo               string // auto | always | never
+	OIDCClaimSubject           []string
+	OIDCClaimEmail             []string
+	OIDCClaimFirstName         []string
+	OIDCClaimLastName          []string
+	OIDCClaimName              []string
+	OIDCClaimGroups            []string
+	OIDCNameOrder              string // last_first | first_last
 	StateSecret                string
 	StateTTL                   time.Duration
+	StateStore                 string // memory | postgres
+	StateStoreDSN              string
 	SecureCookies              bool
 	UserInfoCookieName         string
 	SetUserInfoCookie          bool
 	AllowedEmailDomains        []string // optional allowlist, comma-separated
 	AllowedEmails              []string // optional allowlist, comma-separated
+	AllowedGroups              []string // optional allowlist of IdP groups, comma-separated
+	RoleMapping                []string // group=role1|role2, comma-separated
+	AccessPolicy               string   // CEL expression over verified claims
+	AccessPolicyLists          map[string][]string
+	AllowedRedirectHosts       []string // extra hosts allowed in rd, comma-separated
+	RequireEmailVerified       bool
+	EmailVerifiedExemptDomains []string // domains trusted without email_verified, comma-separated
 	DefaultUserFirstName       string
 	DefaultUserLastName        string
 	HTTPReadTimeout            time.Duration
 	HTTPWriteTimeout           time.Duration
 	HTTPRequestTimeoutBackend  time.Duration
 	ProxyRewriteLocationHeader bool
+	SSOAutoRedirect            bool
+	BackendRelogin             bool
+	StorePath                  string // BoltDB file for local state; empty keeps it in memory
+	CredentialSecret           string
+	CredentialRotateInterval   time.Duration
+	ProtectedAccounts          []string
+	ProtectedAccountsGroup     string
 	LogLevel                   string
+	LogFormat                  string
+	MetricsEnabled             bool
+	MetricsPath                string
+	MetricsAddr                string // separate listener for metrics; empty serves them on ListenAddr
+	TracingEnabled             bool
+	TracingServiceName         string
+	TracingExporter            string // otlp | stdout
+	// Providers — OIDC провайдеры; без OIDC_PROVIDERS единственный провайдер "default" из OIDC_* переменных
+	Providers []ProviderConfig
+}
+
+// ProviderConfig настройки одного OIDC провайдера. Все, кроме реквизитов клиента,
+// по умолчанию наследуются от глобальных переменных.
+type ProviderConfig struct {
+	Name                       string
+	DisplayName                string
+	CallbackPath               string
+	BackchannelPath            string
+	Issuer                     string
+	ClientID                   string
+	ClientSecret               string
+	Scope                      []string
+	PKCE                       bool
+	UserInfo                   string
+	ClaimSubject               []string
+	ClaimEmail                 []string
+	ClaimFirstName             []string
+	ClaimLastName              []string
+	ClaimName                  []string
+	ClaimGroups                []string
+	NameOrder                  string
+	AllowedEmailDomains        []string
+	AllowedEmails              []string
+	AllowedGroups              []string
+	AccessPolicy               string
+	RequireEmailVerified       bool
+	EmailVerifiedExemptDomains []string
 }
 
 func getenv(key, def string) string {
@@ -72,6 +149,15 @@ func getenvDuration(key string, def time.Duration) time.Duration {
 	return def
 }
 
+func getenvInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
 func getenvCSV(key string) []string {
 	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
 		parts := strings.Split(v, ",")
@@ -87,6 +173,128 @@ func getenvCSV(key string) []string {
 	return nil
 }
 
+// getenvCSVPrefix собирает все переменные с префиксом: PREFIX_NAME=a,b -> {"name": [a, b]}
+func getenvCSVPrefix(prefix string) map[string][]string {
+	out := make(map[string][]string)
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		name, ok := strings.CutPrefix(key, prefix)
+		if !ok || name == "" {
+			continue
+		}
+		out[strings.ToLower(name)] = getenvCSV(key)
+	}
+	return out
+}
+
+func getenvCSVDefault(key string, def []string) []string {
+	if v := getenvCSV(key); v != nil {
+		return v
+	}
+	return def
+}
+
+func validProviderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// loadProviders читает OIDC_PROVIDERS=staff,contractors и настройки вида OIDC_STAFF_ISSUER.
+func loadProviders(cfg *Config) ([]ProviderConfig, error) {
+	names := getenvCSV("OIDC_PROVIDERS")
+	if len(names) == 0 {
+		// Один провайдер: прежние переменные и прежний callback путь
+		return []ProviderConfig{{
+			Name:                       "default",
+			DisplayName:                getenv("OIDC_DISPLAY_NAME", "OpenID Connect"),
+			CallbackPath:               cfg.OIDCPath + "callback",
+			BackchannelPath:            cfg.OIDCPath + "backchannel-logout",
+			Issuer:                     cfg.OIDCIssuer,
+			ClientID:                   cfg.OIDCClientID,
+			ClientSecret:               cfg.OIDCClientSecret,
+			Scope:                      cfg.OIDCScope,
+			PKCE:                       cfg.OIDCPKCE,
+			UserInfo:                   cfg.OIDCUserInfo,
+			ClaimSubject:               cfg.OIDCClaimSubject,
+			ClaimEmail:                 cfg.OIDCClaimEmail,
+			ClaimFirstName:             cfg.OIDCClaimFirstName,
+			ClaimLastName:              cfg.OIDCClaimLastName,
+			ClaimName:                  cfg.OIDCClaimName,
+			ClaimGroups:                cfg.OIDCClaimGroups,
+			NameOrder:                  cfg.OIDCNameOrder,
+			AllowedEmailDomains:        cfg.AllowedEmailDomains,
+			AllowedEmails:              cfg.AllowedEmails,
+			AllowedGroups:              cfg.AllowedGroups,
+			AccessPolicy:               cfg.AccessPolicy,
+			RequireEmailVerified:       cfg.RequireEmailVerified,
+			EmailVerifiedExemptDomains: cfg.EmailVerifiedExemptDomains,
+		}}, nil
+	}
+
+	providers := make([]ProviderConfig, 0, len(names))
+	seen := make(map[string]struct{})
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if !validProviderName(name) {
+			return nil, errors.New("invalid provider name in OIDC_PROVIDERS: " + name)
+		}
+		if _, dup := seen[name]; dup {
+			return nil, errors.New("duplicate provider name in OIDC_PROVIDERS: " + name)
+		}
+		seen[name] = struct{}{}
+
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		p := ProviderConfig{
+			Name:                       name,
+			DisplayName:                getenv(prefix+"DISPLAY_NAME", name),
+			CallbackPath:               cfg.OIDCPath + "callback/" + name,
+			BackchannelPath:            cfg.OIDCPath + "backchannel-logout/" + name,
+			Issuer:                     os.Getenv(prefix + "ISSUER"),
+			ClientID:                   os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret:               os.Getenv(prefix + "CLIENT_SECRET"),
+			Scope:                      getenvCSVDefault(prefix+"SCOPE", cfg.OIDCScope),
+			PKCE:                       getenvBool(prefix+"PKCE", cfg.OIDCPKCE),
+			UserInfo:                   getenv(prefix+"USERINFO", cfg.OIDCUserInfo),
+			ClaimSubject:               getenvCSVDefault(prefix+"CLAIM_SUBJECT", cfg.OIDCClaimSubject),
+			ClaimEmail:                 getenvCSVDefault(prefix+"CLAIM_EMAIL", cfg.OIDCClaimEmail),
+			ClaimFirstName:             getenvCSVDefault(prefix+"CLAIM_FIRST_NAME", cfg.OIDCClaimFirstName),
+			ClaimLastName:              getenvCSVDefault(prefix+"CLAIM_LAST_NAME", cfg.OIDCClaimLastName),
+			ClaimName:                  getenvCSVDefault(prefix+"CLAIM_NAME", cfg.OIDCClaimName),
+			ClaimGroups:                getenvCSVDefault(prefix+"CLAIM_GROUPS", cfg.OIDCClaimGroups),
+			NameOrder:                  getenv(prefix+"NAME_ORDER", cfg.OIDCNameOrder),
+			AllowedEmailDomains:        getenvCSVDefault(prefix+"ALLOWED_EMAIL_DOMAINS", cfg.AllowedEmailDomains),
+			AllowedEmails:              getenvCSVDefault(prefix+"ALLOWED_EMAILS", cfg.AllowedEmails),
+			AllowedGroups:              getenvCSVDefault(prefix+"ALLOWED_GROUPS", cfg.AllowedGroups),
+			AccessPolicy:               getenv(prefix+"ACCESS_POLICY", cfg.AccessPolicy),
+			RequireEmailVerified:       getenvBool(prefix+"REQUIRE_EMAIL_VERIFIED", cfg.RequireEmailVerified),
+			EmailVerifiedExemptDomains: getenvCSVDefault(prefix+"EMAIL_VERIFIED_EXEMPT_DOMAINS", cfg.EmailVerifiedExemptDomains),
+		}
+		if p.Issuer == "" || p.ClientID == "" || p.ClientSecret == "" {
+			return nil, errors.New("missing required ENV by provider " + name + ": " +
+				prefix + "ISSUER, " + prefix + "CLIENT_ID, " + prefix + "CLIENT_SECRET")
+		}
+		switch p.UserInfo {
+		case "auto", "always", "never":
+		default:
+			return nil, errors.New("invalid " + prefix + "USERINFO: expected auto, always or never")
+		}
+		switch p.NameOrder {
+		case "last_first", "first_last":
+		default:
+			return nil, errors.New("invalid " + prefix + "NAME_ORDER: expected last_first or first_last")
+		}
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
+
 func loadConfig() (*Config, error) {
 	cfg := &Config{
 		ListenAddr:  getenv("LISTEN_ADDR", ":8080"),
@@ -100,6 +308,7 @@ func loadConfig() (*Config, error) {
 		// Nocodb
 		NocodbAdminEmail:    os.Getenv("NOCODB_ADMIN_EMAIL"),
 		NocodbAdminPassword: os.Getenv("NOCODB_ADMIN_PASSWORD"),
+		NocodbDefaultRole:   getenv("NOCODB_DEFAULT_ROLE", "org-level-creator"),
 		// Plane
 		PlaneDSN: os.Getenv("PLANE_DSN"),
 		// OIDC
@@ -109,30 +318,83 @@ func loadConfig() (*Config, error) {
 		OIDCPath:                   getenv("OIDC_PATH", "/openid/"),
 		OIDCScope:                  getenvCSV("OIDC_SCOPE"),
 		OIDCPrompt:                 getenv("OIDC_PROMPT", ""),
+		OIDCPKCE:                   getenvBool("OIDC_PKCE", false),
+		OIDCPostLogoutURL:          os.Getenv("OIDC_POST_LOGOUT_REDIRECT_URL"),
+		OIDCRPLogout:               getenvBool("OIDC_RP_LOGOUT", true),
+		LogoutBackendSession:       getenvBool("LOGOUT_BACKEND_SESSION", true),
+		BackchannelLogout:          getenvBool("BACKCHANNEL_LOGOUT", false),
+		BackchannelSessionTTL:      getenvDuration("BACKCHANNEL_SESSION_TTL", 14*24*time.Hour),
+		SessionEnforce:             getenvBool("SESSION_ENFORCE", false),
+		SessionSecret:              os.Getenv("SESSION_SECRET"),
+		SessionCookieName:          getenv("SESSION_COOKIE_NAME", "oidc_session"),
+		SessionCookieDomain:        os.Getenv("SESSION_COOKIE_DOMAIN"),
+		SessionTTL:                 getenvDuration("SESSION_TTL", 8*time.Hour),
+		SessionExemptPaths:         getenvCSV("SESSION_EXEMPT_PATHS"),
+		ForwardAuth:                getenvBool("FORWARD_AUTH", false),
+		ForwardAuthPath:            getenv("FORWARD_AUTH_PATH", "/auth"),
+		OIDCUserInfo:               getenv("OIDC_USERINFO", "auto"),
+		OIDCClaimSubject:           getenvCSV("OIDC_CLAIM_SUBJECT"),
+		OIDCClaimEmail:             getenvCSV("OIDC_CLAIM_EMAIL"),
+		OIDCClaimFirstName:         getenvCSV("OIDC_CLAIM_FIRST_NAME"),
+		OIDCClaimLastName:          getenvCSV("OIDC_CLAIM_LAST_NAME"),
+		OIDCClaimName:              getenvCSV("OIDC_CLAIM_NAME"),
+		OIDCClaimGroups:            getenvCSV("OIDC_CLAIM_GROUPS"),
+		OIDCNameOrder:              getenv("OIDC_NAME_ORDER", "last_first"),
 		StateSecret:                os.Getenv("STATE_SECRET"),
 		StateTTL:                   getenvDuration("STATE_TTL", 10*time.Minute),
+		StateStore:                 getenv("STATE_STORE", "memory"),
+		StateStoreDSN:              os.Getenv("STATE_STORE_DSN"),
 		SecureCookies:              getenvBool("SECURE_COOKIES", true),
 		UserInfoCookieName:         getenv("USERINFO_COOKIE_NAME", "oidc_user"),
 		SetUserInfoCookie:          getenvBool("SET_USERINFO_COOKIE", true),
 		AllowedEmailDomains:        getenvCSV("ALLOWED_EMAIL_DOMAINS"),
 		AllowedEmails:              getenvCSV("ALLOWED_EMAILS"),
+		AllowedGroups:              getenvCSV("ALLOWED_GROUPS"),
+		RoleMapping:                getenvCSV("ROLE_MAPPING"),
+		AccessPolicy:               os.Getenv("ACCESS_POLICY"),
+		AccessPolicyLists:          getenvCSVPrefix("ACCESS_POLICY_LIST_"),
+		AllowedRedirectHosts:       getenvCSV("ALLOWED_REDIRECT_HOSTS"),
+		RequireEmailVerified:       getenvBool("REQUIRE_EMAIL_VERIFIED", false),
+		EmailVerifiedExemptDomains: getenvCSV("EMAIL_VERIFIED_EXEMPT_DOMAINS"),
 		DefaultUserFirstName:       getenv("DEFAULT_USER_FIRST_NAME", "User"),
 		DefaultUserLastName:        getenv("DEFAULT_USER_LAST_NAME", "OIDC"),
 		HTTPReadTimeout:            getenvDuration("HTTP_READ_TIMEOUT", 15*time.Second),
 		HTTPWriteTimeout:           getenvDuration("HTTP_WRITE_TIMEOUT", 60*time.Second),
 		HTTPRequestTimeoutBackend:  getenvDuration("HTTP_BACKEND_TIMEOUT", 60*time.Second),
 		ProxyRewriteLocationHeader: getenvBool("PROXY_REWRITE_LOCATION", true),
+		SSOAutoRedirect:            getenvBool("SSO_AUTO_REDIRECT", false),
+		BackendRelogin:             getenvBool("BACKEND_RELOGIN", true),
+		StorePath:                  os.Getenv("STORE_PATH"),
+		CredentialSecret:           os.Getenv("CREDENTIAL_SECRET"),
+		CredentialRotateInterval:   getenvDuration("CREDENTIAL_ROTATE_INTERVAL", 30*24*time.Hour),
+		ProtectedAccounts:          getenvCSV("PROTECTED_ACCOUNTS"),
+		ProtectedAccountsGroup:     os.Getenv("PROTECTED_ACCOUNTS_GROUP"),
 		LogLevel:                   getenv("LOG_LEVEL", "info"),
+		LogFormat:                  getenv("LOG_FORMAT", "text"),
+		MetricsEnabled:             getenvBool("METRICS_ENABLED", false),
+		MetricsPath:                getenv("METRICS_PATH", "/metrics"),
+		MetricsAddr:                os.Getenv("METRICS_ADDR"),
+		TracingEnabled:             getenvBool("TRACING_ENABLED", false),
+		TracingServiceName:         getenv("OTEL_SERVICE_NAME", "any-oidc-proxy"),
+		TracingExporter:            getenv("TRACING_EXPORTER", "otlp"),
 	}
 
+	multiProvider := len(getenvCSV("OIDC_PROVIDERS")) > 0
 	if cfg.ExternalURL == "" ||
-		cfg.OIDCIssuer == "" ||
-		cfg.OIDCClientID == "" ||
-		cfg.OIDCClientSecret == "" ||
+		(!multiProvider && (cfg.OIDCIssuer == "" ||
+			cfg.OIDCClientID == "" ||
+			cfg.OIDCClientSecret == "")) ||
 		cfg.StateSecret == "" {
 		return nil, errors.New("missing required ENV: EXTERNAL_URL, METABASE_URL, METABASE_ADMIN_EMAIL, METABASE_ADMIN_PASSWORD, OIDC_ISSUER, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET, STATE_SECRET")
 	}
 
+	if cfg.SessionSecret == "" {
+		cfg.SessionSecret = cfg.StateSecret
+	}
+	if cfg.CredentialSecret == "" {
+		cfg.CredentialSecret = cfg.StateSecret
+	}
+
 	// Normalize OIDC path
 	if !strings.HasPrefix(cfg.OIDCPath, "/") {
 		cfg.OIDCPath = "/" + cfg.OIDCPath
@@ -143,7 +405,7 @@ func loadConfig() (*Config, error) {
 	if len(cfg.OIDCScope) == 0 {
 		cfg.OIDCScope = []string{"openid", "email", "profile"}
 	}
-	if cfg.ProxyURL == "" {
+	if cfg.ProxyURL == "" && cfg.Type != "none" {
 		return nil, errors.New("missing required ENV by metabase: PROXY_URL")
 	}
 	if cfg.Type == "metabase" && (cfg.MetabaseAdminEmail == "" ||
@@ -154,8 +416,36 @@ func loadConfig() (*Config, error) {
 		cfg.NocodbAdminPassword == "") {
 		return nil, errors.New("missing required ENV by metabase: NOCODB_ADMIN_EMAIL, NOCODB_ADMIN_PASSWORD")
 	}
+	switch cfg.OIDCUserInfo {
+	case "auto", "always", "never":
+	default:
+		return nil, errors.New("invalid OIDC_USERINFO: expected auto, always or never")
+	}
+	switch cfg.OIDCNameOrder {
+	case "last_first", "first_last":
+	default:
+		return nil, errors.New("invalid OIDC_NAME_ORDER: expected last_first or first_last")
+	}
+	switch cfg.StateStore {
+	case "memory":
+	case "postgres":
+		if cfg.StateStoreDSN == "" {
+			return nil, errors.New("missing required ENV by postgres state store: STATE_STORE_DSN")
+		}
+	default:
+		return nil, errors.New("invalid STATE_STORE: expected memory or postgres")
+	}
+	// Без постоянного хранилища пароли и связи с IdP теряются при перезапуске и расходятся между репликами
+	if cfg.StorePath == "" && cfg.Type != "none" {
+		return nil, errors.New("missing required ENV: STORE_PATH (STORE_PATH=memory keeps passwords in memory until restart)")
+	}
 	if cfg.Type == "plane" && cfg.PlaneDSN == "" {
 		return nil, errors.New("missing required ENV by metabase: PLANE_DSN")
 	}
+	providers, err := loadProviders(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Providers = providers
 	return cfg, nil
 }
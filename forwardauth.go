@@ -0,0 +1,73 @@
+package main
+
+import (
+	"any-oidc-proxy/pkg/logging"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// handleForwardAuth отвечает ingress'у (nginx auth_request, Traefik ForwardAuth), пускать ли запрос:
+// 200 с заголовками X-Auth-Request-* при действующей сессии прокси, иначе 401. Переход браузера,
+// пришедший с X-Forwarded-Uri (Traefik), сразу перенаправляется на логин.
+func (a *App) handleForwardAuth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	session, err := a.proxySessions.Verify(r)
+	if err == nil {
+		oidcAuth := a.provider(session.Provider)
+		if oidcAuth == nil {
+			logging.FromContext(r.Context()).Debugf("forward auth: unknown provider %q", session.Provider)
+		} else if err := oidcAuth.Authorize(r.Context(), session); err != nil {
+			logging.FromContext(r.Context()).Infof("forward auth: %s denied: %v", session.Email, err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		} else {
+			w.Header().Set("X-Auth-Request-Email", session.Email)
+			w.Header().Set("X-Auth-Request-User", session.User)
+			w.Header().Set("X-Auth-Request-Groups", strings.Join(session.Groups, ","))
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+
+	if uri := r.Header.Get("X-Forwarded-Uri"); uri != "" && isForwardedNavigation(r) {
+		http.Redirect(w, r, a.externalLoginURL(forwardedURL(r, uri)), http.StatusFound)
+		return
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// isForwardedNavigation — isNavigation для исходного запроса, описанного заголовками ingress'а.
+func isForwardedNavigation(r *http.Request) bool {
+	method := r.Header.Get("X-Forwarded-Method")
+	if method != "" && method != http.MethodGet && method != http.MethodHead {
+		return false
+	}
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// forwardedURL восстанавливает адрес исходного запроса из X-Forwarded-* заголовков.
+func forwardedURL(r *http.Request, uri string) string {
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		return uri
+	}
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "https"
+	}
+	return proto + "://" + host + uri
+}
+
+// externalLoginURL — loginURL на EXTERNAL_URL, для браузера, находящегося на другом хосте.
+func (a *App) externalLoginURL(rd string) string {
+	login, err := url.JoinPath(a.config.ExternalURL, a.config.OIDCPath)
+	if err != nil {
+		return a.loginURL(rd)
+	}
+	return login + "?rd=" + url.QueryEscape(rd)
+}
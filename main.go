@@ -1,15 +1,16 @@
 package main
 
 import (
-	"log"
+	"any-oidc-proxy/pkg/logging"
 
 	"github.com/joho/godotenv"
+	log "github.com/sirupsen/logrus"
 )
 
 func init() {
 	// loads values from .env into the system
 	if err := godotenv.Load(); err != nil {
-		log.Print("No .env file found")
+		log.Info("No .env file found")
 	}
 }
 
@@ -18,6 +19,11 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// Значения сессионных кук бэкенда и прокси не должны попадать в логи
+	cookies := append(sessionCookieNames(config), config.SessionCookieName)
+	if err := logging.Setup(config.LogLevel, config.LogFormat, cookies...); err != nil {
+		log.Fatal(err)
+	}
 	app, err := newApp(config)
 	if err != nil {
 		log.Fatal(err)
@@ -10,7 +10,9 @@ type UserData struct {
 	Email     string
 	FirstName string
 	LastName  string
-	Subject   string // OIDC sub
+	Subject   string   // OIDC sub
+	Issuer    string   // OIDC iss, вместе с Subject однозначно определяет пользователя
+	Groups    []string // группы/роли пользователя из IdP
 }
 
 // Backend интерфейс для взаимодействия с целевой системой
@@ -22,8 +24,42 @@ type Backend interface {
 	Login(ctx context.Context, userID string, userData UserData) ([]string, error)
 }
 
+// SessionTerminator — опциональный интерфейс бэкенда для завершения сессии на стороне сервера
+type SessionTerminator interface {
+	// Logout закрывает сессию, которой принадлежат куки браузера
+	Logout(ctx context.Context, cookies []*http.Cookie) error
+}
+
+// LoginPageDetector — опциональный интерфейс бэкенда: распознаёт переходы на его собственную страницу входа
+type LoginPageDetector interface {
+	// LoginRedirect сообщает, ведёт ли навигация на страницу входа, и куда вернуть пользователя после SSO
+	LoginRedirect(r *http.Request) (string, bool)
+}
+
+// SessionExpiryDetector — опциональный интерфейс бэкенда: распознаёт ответ, означающий,
+// что сессия пользователя в бэкенде истекла и её можно восстановить повторным Login
+type SessionExpiryDetector interface {
+	SessionExpired(resp *http.Response) bool
+}
+
 // CookieManager управляет куками сессии
 type CookieManager interface {
 	SetSessionCookies(w http.ResponseWriter, r *http.Request, cookies []string)
-	ClearSessionCookies(w http.ResponseWriter)
+	ClearSessionCookies(w http.ResponseWriter, r *http.Request)
+	// RewriteCookies приводит Set-Cookie бэкенда к виду, в котором их получает браузер
+	RewriteCookies(r *http.Request, cookies []string) []string
+}
+
+// Options общие настройки бэкендов
+type Options struct {
+	// Roles — таблица соответствия групп IdP ролям бэкенда, применяется при каждом логине
+	Roles RoleMapping
+	// SessionCookie — имя сессионной куки бэкенда, если оно настраивается (Metabase)
+	SessionCookie string
+	// Credentials — хранилище паролей, с которыми прокси входит в бэкенд от имени пользователей
+	Credentials *Credentials
+	// Protection — учётные записи, в которые нельзя войти через SSO
+	Protection Protection
+	// Identities — связи пользователей IdP с учётными записями бэкенда; nil — поиск только по email
+	Identities Identities
 }
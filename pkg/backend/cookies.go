@@ -1,35 +1,56 @@
 package backend
 
 import (
+	"net"
 	"net/http"
 )
 
 type SimpleCookieManager struct {
-	secure     bool
-	cookieName string
+	secure      bool
+	cookieNames []string
 }
 
-func NewSimpleCookieManager(secure bool, cookieName string) *SimpleCookieManager {
+// NewSimpleCookieManager создаёт менеджер куков; cookieNames — сессионные куки бэкенда, удаляемые при выходе.
+func NewSimpleCookieManager(secure bool, cookieNames ...string) *SimpleCookieManager {
 	return &SimpleCookieManager{
-		secure:     secure,
-		cookieName: cookieName,
+		secure:      secure,
+		cookieNames: cookieNames,
 	}
 }
 
 func (m *SimpleCookieManager) SetSessionCookies(w http.ResponseWriter, r *http.Request, cookies []string) {
-	for _, cookie := range cookies {
-		rewritten := rewriteSetCookieDomain(cookie, r.Host, m.secure)
+	for _, rewritten := range m.RewriteCookies(r, cookies) {
 		w.Header().Add("Set-Cookie", rewritten)
 	}
 }
 
-func (m *SimpleCookieManager) ClearSessionCookies(w http.ResponseWriter) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     m.cookieName,
-		Value:    "",
-		Path:     "/",
-		MaxAge:   -1,
-		HttpOnly: true,
-		Secure:   m.secure,
-	})
+func (m *SimpleCookieManager) RewriteCookies(r *http.Request, cookies []string) []string {
+	out := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		out = append(out, rewriteSetCookieDomain(cookie, r.Host, m.secure))
+	}
+	return out
+}
+
+// ClearSessionCookies удаляет сессионные куки бэкенда. Кука с Domain и host-only кука с тем же
+// именем для браузера разные, а RewriteCookies сохраняет Domain, если его выставил бэкенд, поэтому
+// удаляются обе.
+func (m *SimpleCookieManager) ClearSessionCookies(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, name := range m.cookieNames {
+		for _, domain := range []string{"", host} {
+			http.SetCookie(w, &http.Cookie{
+				Name:     name,
+				Value:    "",
+				Path:     "/",
+				Domain:   domain,
+				MaxAge:   -1,
+				HttpOnly: true,
+				Secure:   m.secure,
+			})
+		}
+	}
 }
@@ -0,0 +1,40 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClearSessionCookies(t *testing.T) {
+	tests := []struct {
+		name       string
+		host       string
+		wantDomain string
+	}{
+		{name: "host", host: "analytics.example.com", wantDomain: "analytics.example.com"},
+		{name: "host with port", host: "analytics.example.com:8443", wantDomain: "analytics.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewSimpleCookieManager(true, "metabase.SESSION")
+			r := httptest.NewRequest(http.MethodPost, "/oidc/logout", nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			m.ClearSessionCookies(w, r)
+
+			// Удаляются и host-only кука, и кука с Domain, которую выставил RewriteCookies
+			domains := map[string]bool{}
+			for _, c := range w.Result().Cookies() {
+				if c.Name != "metabase.SESSION" || c.MaxAge >= 0 {
+					t.Errorf("unexpected cookie %s", c)
+				}
+				domains[strings.TrimPrefix(c.Domain, ".")] = true
+			}
+			if len(domains) != 2 || !domains[""] || !domains[tt.wantDomain] {
+				t.Errorf("cleared cookie domains = %v, want host-only and %q", domains, tt.wantDomain)
+			}
+		})
+	}
+}
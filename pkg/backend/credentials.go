@@ -0,0 +1,114 @@
+package backend
+
+import (
+	"any-oidc-proxy/pkg/logging"
+	"any-oidc-proxy/pkg/store"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const credentialsBucket = "credentials"
+
+// ErrInvalidCredentials — бэкенд отверг пароль пользователя. Только в этом случае Credentials
+// меняет пароль: сбой сети или 5xx смена пароля не исправит, а другие сессии пользователя закроет.
+var ErrInvalidCredentials = errors.New("backend rejected the password")
+
+// Credentials хранит пароль каждого пользователя в бэкенде, зашифрованный AES-GCM, и меняет его
+// только по расписанию или если вход с ним не удался. Смена пароля закрывает остальные сессии
+// пользователя в Metabase и Plane, поэтому менять его на каждом логине нельзя.
+type Credentials struct {
+	store    store.Store
+	aead     cipher.AEAD
+	rotate   time.Duration
+	generate func() string
+}
+
+type credential struct {
+	Password  string    `json:"password"`
+	RotatedAt time.Time `json:"rotated_at"`
+}
+
+// NewCredentials создаёт хранилище паролей. rotate — срок жизни пароля, generate — генератор новых паролей.
+func NewCredentials(s store.Store, secret string, rotate time.Duration, generate func() string) (*Credentials, error) {
+	if secret == "" {
+		return nil, errors.New("empty credential secret")
+	}
+	key := sha256.Sum256([]byte("backend-credentials:" + secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Credentials{store: s, aead: aead, rotate: rotate, generate: generate}, nil
+}
+
+// Login входит в бэкенд с сохранённым паролем пользователя key. Если пароля нет, он устарел
+// или бэкенд его не принял (login вернул ErrInvalidCredentials), задаёт новый через setPassword,
+// запоминает и входит с ним.
+func (c *Credentials) Login(
+	ctx context.Context,
+	key string,
+	setPassword func(ctx context.Context, password string) error,
+	login func(ctx context.Context, password string) ([]string, error),
+) ([]string, error) {
+	if cred, ok := c.load(ctx, key); ok && time.Since(cred.RotatedAt) < c.rotate {
+		cookies, err := login(ctx, cred.Password)
+		if !errors.Is(err, ErrInvalidCredentials) {
+			return cookies, err
+		}
+		logging.FromContext(ctx).Infof("stored credential for %s rejected, rotating: %v", key, err)
+	}
+
+	password := c.generate()
+	if err := setPassword(ctx, password); err != nil {
+		return nil, err
+	}
+	if err := c.save(key, credential{Password: password, RotatedAt: time.Now()}); err != nil {
+		// Без сохранения следующий логин просто сменит пароль ещё раз
+		logging.FromContext(ctx).Warnf("failed to store credential for %s: %v", key, err)
+	}
+	return login(ctx, password)
+}
+
+func (c *Credentials) load(ctx context.Context, key string) (credential, bool) {
+	sealed, err := c.store.Get(credentialsBucket, key)
+	if err != nil {
+		logging.FromContext(ctx).Warnf("failed to read credential for %s: %v", key, err)
+		return credential{}, false
+	}
+	if len(sealed) < c.aead.NonceSize() {
+		return credential{}, false
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plain, err := c.aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		// Другой ключ шифрования или повреждённая запись — пароль будет задан заново
+		return credential{}, false
+	}
+	var cred credential
+	if err := json.Unmarshal(plain, &cred); err != nil {
+		return credential{}, false
+	}
+	return cred, true
+}
+
+func (c *Credentials) save(key string, cred credential) error {
+	plain, err := json.Marshal(cred)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	return c.store.Put(credentialsBucket, key, c.aead.Seal(nonce, nonce, plain, []byte(key)))
+}
@@ -0,0 +1,146 @@
+package backend
+
+import (
+	"any-oidc-proxy/pkg/store"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeAccount — учётная запись бэкенда с паролем, который можно сменить.
+type fakeAccount struct {
+	password string
+	resets   int
+	loginErr error // ответ бэкенда на любой вход, если задан
+	resetErr error
+}
+
+func (f *fakeAccount) setPassword(_ context.Context, password string) error {
+	if f.resetErr != nil {
+		return f.resetErr
+	}
+	f.resets++
+	f.password = password
+	return nil
+}
+
+func (f *fakeAccount) login(_ context.Context, password string) ([]string, error) {
+	if f.loginErr != nil {
+		return nil, f.loginErr
+	}
+	if password != f.password {
+		return nil, fmt.Errorf("login failed: %w", ErrInvalidCredentials)
+	}
+	return []string{"session=" + password}, nil
+}
+
+func newTestCredentials(t *testing.T, s store.Store, secret string, rotate time.Duration) *Credentials {
+	t.Helper()
+	n := 0
+	c, err := NewCredentials(s, secret, rotate, func() string {
+		n++
+		return fmt.Sprintf("%s-%d", secret, n)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCredentialsLogin(t *testing.T) {
+	tests := []struct {
+		name string
+		// prepare готовит хранилище и бэкенд к проверяемому входу; по умолчанию — один успешный вход
+		prepare    func(t *testing.T, c *Credentials, acc *fakeAccount)
+		secret     string
+		rotate     time.Duration
+		wantResets int
+		wantErr    bool
+	}{
+		{
+			name:       "first login sets a password",
+			prepare:    func(*testing.T, *Credentials, *fakeAccount) {},
+			wantResets: 1,
+		},
+		{
+			name:       "stored password is reused",
+			wantResets: 1,
+		},
+		{
+			name:       "stale password is rotated",
+			rotate:     -time.Second,
+			wantResets: 2,
+		},
+		{
+			name: "rejected password is rotated",
+			prepare: func(t *testing.T, c *Credentials, acc *fakeAccount) {
+				login(t, c, acc)
+				acc.password = "changed-by-admin"
+			},
+			wantResets: 2,
+		},
+		{
+			name: "backend outage keeps the password",
+			prepare: func(t *testing.T, c *Credentials, acc *fakeAccount) {
+				login(t, c, acc)
+				acc.loginErr = errors.New("502 bad gateway")
+			},
+			wantResets: 1,
+			wantErr:    true,
+		},
+		{
+			name: "failed reset is reported",
+			prepare: func(t *testing.T, c *Credentials, acc *fakeAccount) {
+				login(t, c, acc)
+				acc.password = "changed-by-admin"
+				acc.resetErr = errors.New("403 forbidden")
+			},
+			wantResets: 1,
+			wantErr:    true,
+		},
+		{
+			name:       "other secret cannot read the password",
+			secret:     "rotated-secret",
+			wantResets: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := store.NewMemoryStore()
+			rotate := tt.rotate
+			if rotate == 0 {
+				rotate = time.Hour
+			}
+			c := newTestCredentials(t, s, "secret", rotate)
+			acc := &fakeAccount{}
+			if tt.prepare != nil {
+				tt.prepare(t, c, acc)
+			} else {
+				login(t, c, acc)
+			}
+			if tt.secret != "" {
+				c = newTestCredentials(t, s, tt.secret, rotate)
+			}
+
+			cookies, err := c.Login(context.Background(), "user", acc.setPassword, acc.login)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Login() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (len(cookies) != 1 || cookies[0] != "session="+acc.password) {
+				t.Errorf("Login() cookies = %v, want session for %q", cookies, acc.password)
+			}
+			if acc.resets != tt.wantResets {
+				t.Errorf("password set %d times, want %d", acc.resets, tt.wantResets)
+			}
+		})
+	}
+}
+
+func login(t *testing.T, c *Credentials, acc *fakeAccount) {
+	t.Helper()
+	if _, err := c.Login(context.Background(), "user", acc.setPassword, acc.login); err != nil {
+		t.Fatal(err)
+	}
+}
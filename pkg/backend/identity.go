@@ -0,0 +1,83 @@
+package backend
+
+import (
+	"any-oidc-proxy/pkg/store"
+	"context"
+	"encoding/json"
+)
+
+const identitiesBucket = "identities"
+
+// Identity — учётная запись бэкенда, связанная с пользователем IdP.
+type Identity struct {
+	UserID string `json:"user_id"`
+	Email  string `json:"email"` // email учётной записи в бэкенде на момент последнего входа
+}
+
+// Identities связывает пользователя IdP (issuer + sub) с учётной записью бэкенда, чтобы после
+// смены email в IdP пользователь попадал в прежнюю учётную запись, а не в новую пустую.
+type Identities interface {
+	// Lookup возвращает nil без ошибки, если связи нет
+	Lookup(ctx context.Context, issuer, subject string) (*Identity, error)
+	Link(ctx context.Context, issuer, subject string, id Identity) error
+}
+
+// StoreIdentities хранит связи в локальном хранилище прокси.
+type StoreIdentities struct {
+	store     store.Store
+	namespace string
+}
+
+// NewStoreIdentities создаёт хранилище связей; namespace отделяет связи разных бэкендов в одном файле.
+func NewStoreIdentities(s store.Store, namespace string) *StoreIdentities {
+	return &StoreIdentities{store: s, namespace: namespace}
+}
+
+func (s *StoreIdentities) key(issuer, subject string) string {
+	return s.namespace + "\x00" + issuer + "\x00" + subject
+}
+
+func (s *StoreIdentities) Lookup(_ context.Context, issuer, subject string) (*Identity, error) {
+	raw, err := s.store.Get(identitiesBucket, s.key(issuer, subject))
+	if err != nil || raw == nil {
+		return nil, err
+	}
+	var id Identity
+	if err := json.Unmarshal(raw, &id); err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+func (s *StoreIdentities) Link(_ context.Context, issuer, subject string, id Identity) error {
+	raw, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(identitiesBucket, s.key(issuer, subject), raw)
+}
+
+// LookupIdentity ищет связь пользователя, если хранилище задано и IdP прислал issuer и sub.
+func LookupIdentity(ctx context.Context, ids Identities, user UserData) (*Identity, error) {
+	if ids == nil || user.Issuer == "" || user.Subject == "" {
+		return nil, nil
+	}
+	return ids.Lookup(ctx, user.Issuer, user.Subject)
+}
+
+// LinkIdentity запоминает связь пользователя с учётной записью, если это возможно.
+func LinkIdentity(ctx context.Context, ids Identities, user UserData, id Identity) error {
+	if ids == nil || user.Issuer == "" || user.Subject == "" {
+		return nil
+	}
+	return ids.Link(ctx, user.Issuer, user.Subject, id)
+}
+
+// AccountEmail — email, под которым пользователь входит в бэкенд: email связанной учётной
+// записи, если бэкенд не дал его поменять, иначе email из IdP.
+func AccountEmail(ctx context.Context, ids Identities, user UserData) string {
+	if id, err := LookupIdentity(ctx, ids, user); err == nil && id != nil && id.Email != "" {
+		return id.Email
+	}
+	return user.Email
+}
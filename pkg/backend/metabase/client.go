@@ -1,6 +1,9 @@
 package metabase
 
 import (
+	"any-oidc-proxy/pkg/backend"
+	"any-oidc-proxy/pkg/metrics"
+	"any-oidc-proxy/pkg/tracing"
 	"context"
 	"encoding/json"
 	"errors"
@@ -12,6 +15,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type ClientOIDC struct {
@@ -31,13 +36,15 @@ type User struct {
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
 	IsActive  bool   `json:"is_active"`
+
+	IsSuperuser bool `json:"is_superuser"`
 }
 
 type UserData struct {
 	Data []User `json:"data"`
 }
 
-func (m *ClientOIDC) ensureAdmin(ctx context.Context) error {
+func (m *ClientOIDC) ensureAdmin(ctx context.Context) (err error) {
 	m.AdminSessionMu.Lock()
 	defer m.AdminSessionMu.Unlock()
 
@@ -45,6 +52,9 @@ func (m *ClientOIDC) ensureAdmin(ctx context.Context) error {
 	if m.AdminSession != "" && time.Now().Before(m.AdminSessionExp) {
 		return nil
 	}
+	defer func() { metrics.AdminSessionRefresh("metabase", err) }()
+	ctx, span := tracing.Start(ctx, "metabase.adminLogin")
+	defer func() { tracing.End(span, err) }()
 	// login
 	loginURL := m.BaseURL.ResolveReference(&url.URL{Path: "/api/session"})
 	body := map[string]string{
@@ -83,7 +93,13 @@ func (m *ClientOIDC) doJSON(
 	method string,
 	urlPath *url.URL,
 	in any,
-) (*http.Response, error) {
+) (resp *http.Response, err error) {
+	ctx, span := tracing.Start(ctx, "metabase.doJSON",
+		attribute.String("http.request.method", method),
+		attribute.String("url.path", urlPath.Path),
+	)
+	defer func() { tracing.End(span, err) }()
+
 	if err := m.ensureAdmin(ctx); err != nil {
 		return nil, err
 	}
@@ -96,7 +112,7 @@ func (m *ClientOIDC) doJSON(
 	req, _ := http.NewRequestWithContext(ctx, method, u.String(), body)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("X-Metabase-Session", m.AdminSession)
-	resp, err := m.HTTP.Do(req)
+	resp, err = m.HTTP.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -158,6 +174,27 @@ func (m *ClientOIDC) FindUserByEmail(ctx context.Context, email string) (*User,
 	return nil, nil
 }
 
+// GetUser возвращает пользователя по id или nil, если его нет.
+func (m *ClientOIDC) GetUser(ctx context.Context, id int) (*User, error) {
+	resp, err := m.doJSON(ctx, http.MethodGet, &url.URL{Path: "/api/user/" + strconv.Itoa(id)}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("get user failed: %s", strings.TrimSpace(string(b)))
+	}
+	var user User
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
 func (m *ClientOIDC) CreateUser(ctx context.Context, email, first, last, password string) (*User, error) {
 	body := map[string]any{
 		"email":      email,
@@ -217,12 +254,13 @@ func (m *ClientOIDC) ResetPassword(ctx context.Context, id int, newPassword stri
 		"password": newPassword,
 	}
 	resp, err := m.doJSON(ctx, http.MethodPut, path, body)
-	if err == nil && (resp.StatusCode == 200 || resp.StatusCode == 204) {
-		resp.Body.Close()
-		return nil
+	if err != nil {
+		return err
 	}
-	if resp != nil {
-		resp.Body.Close()
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("reset password failed (%d): %s", resp.StatusCode, strings.TrimSpace(string(b)))
 	}
 	return nil
 }
@@ -239,6 +277,9 @@ func (m *ClientOIDC) FindOrCreateUser(ctx context.Context, email, first, last, p
 }
 
 func (m *ClientOIDC) LoginUser(ctx context.Context, email, password string) (sessionID string, setCookies []string, err error) {
+	ctx, span := tracing.Start(ctx, "metabase.LoginUser")
+	defer func() { tracing.End(span, err) }()
+
 	loginURL := m.BaseURL.ResolveReference(&url.URL{Path: "/api/session"})
 	body := map[string]string{
 		"username": email,
@@ -252,6 +293,10 @@ func (m *ClientOIDC) LoginUser(ctx context.Context, email, password string) (ses
 		return "", nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		b, _ := io.ReadAll(resp.Body)
+		return "", nil, fmt.Errorf("user login failed: %w: %s", backend.ErrInvalidCredentials, strings.TrimSpace(string(b)))
+	}
 	if resp.StatusCode != 200 {
 		b, _ := io.ReadAll(resp.Body)
 		return "", nil, fmt.Errorf("user login failed: %s", strings.TrimSpace(string(b)))
@@ -264,3 +309,100 @@ func (m *ClientOIDC) LoginUser(ctx context.Context, email, password string) (ses
 	}
 	return sr.ID, resp.Header.Values("Set-Cookie"), nil
 }
+
+type Group struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type Membership struct {
+	MembershipID int `json:"membership_id"`
+	GroupID      int `json:"group_id"`
+	UserID       int `json:"user_id"`
+}
+
+func (m *ClientOIDC) ListGroups(ctx context.Context) ([]Group, error) {
+	resp, err := m.doJSON(ctx, http.MethodGet, &url.URL{Path: "/api/permissions/group"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("list groups failed: %s", strings.TrimSpace(string(b)))
+	}
+	var groups []Group
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// ListMemberships возвращает членства в группах, сгруппированные по ID пользователя.
+func (m *ClientOIDC) ListMemberships(ctx context.Context) (map[string][]Membership, error) {
+	resp, err := m.doJSON(ctx, http.MethodGet, &url.URL{Path: "/api/permissions/membership"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("list memberships failed: %s", strings.TrimSpace(string(b)))
+	}
+	var memberships map[string][]Membership
+	if err := json.NewDecoder(resp.Body).Decode(&memberships); err != nil {
+		return nil, err
+	}
+	return memberships, nil
+}
+
+func (m *ClientOIDC) AddMembership(ctx context.Context, groupID, userID int) error {
+	body := map[string]any{
+		"group_id": groupID,
+		"user_id":  userID,
+	}
+	resp, err := m.doJSON(ctx, http.MethodPost, &url.URL{Path: "/api/permissions/membership"}, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("add membership failed: %s", strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+func (m *ClientOIDC) RemoveMembership(ctx context.Context, membershipID int) error {
+	path := &url.URL{Path: "/api/permissions/membership/" + strconv.Itoa(membershipID)}
+	resp, err := m.doJSON(ctx, http.MethodDelete, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("remove membership failed: %s", strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// Logout закрывает пользовательскую сессию, переданную в куках браузера.
+func (m *ClientOIDC) Logout(ctx context.Context, cookies []*http.Cookie) error {
+	u := m.BaseURL.ResolveReference(&url.URL{Path: "/api/session"})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodDelete, u.String(), nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	resp, err := m.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// 401 — сессия уже недействительна
+	if resp.StatusCode != 200 && resp.StatusCode != 204 && resp.StatusCode != http.StatusUnauthorized {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("logout failed: %s", strings.TrimSpace(string(b)))
+	}
+	return nil
+}
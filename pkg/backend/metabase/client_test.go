@@ -0,0 +1,57 @@
+package metabase
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestClient — клиент к фейковому Metabase с уже полученной админской сессией.
+func newTestClient(t *testing.T, h http.Handler) *ClientOIDC {
+	t.Helper()
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	base, _ := url.Parse(server.URL)
+	return &ClientOIDC{
+		BaseURL:         base,
+		HTTP:            server.Client(),
+		AdminSession:    "admin-session",
+		AdminSessionMu:  &sync.Mutex{},
+		AdminSessionExp: time.Now().Add(time.Hour),
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		down    bool
+		wantErr bool
+	}{
+		{name: "ok", status: http.StatusOK},
+		{name: "no content", status: http.StatusNoContent},
+		{name: "rejected", status: http.StatusBadRequest, wantErr: true},
+		{name: "forbidden", status: http.StatusForbidden, wantErr: true},
+		{name: "unreachable", down: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPut || r.URL.Path != "/api/user/7/password" {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			if tt.down {
+				c.BaseURL, _ = url.Parse("http://127.0.0.1:1")
+			}
+			if err := c.ResetPassword(context.Background(), 7, "new-password"); (err != nil) != tt.wantErr {
+				t.Errorf("ResetPassword() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
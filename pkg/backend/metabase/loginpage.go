@@ -0,0 +1,40 @@
+package metabase
+
+import (
+	"net/http"
+	"strings"
+)
+
+// publicPrefixes — страницы Metabase, которые открываются без сессии: публичные ссылки,
+// встраивание, восстановление пароля, статика и API.
+var publicPrefixes = []string{"/public/", "/embed/", "/auth/", "/app/", "/api/"}
+
+// LoginRedirect распознаёт страницу входа Metabase. Без сессии SPA сама переходит на
+// /auth/login?redirect=..., не обращаясь к серверу, поэтому навигация без сессионной куки
+// тоже считается входом.
+func (m *MetabaseBackend) LoginRedirect(r *http.Request) (string, bool) {
+	if strings.TrimSuffix(r.URL.Path, "/") == "/auth/login" {
+		rd := r.URL.Query().Get("redirect")
+		if rd == "" {
+			rd = "/"
+		}
+		return rd, true
+	}
+
+	if c, err := r.Cookie(m.sessionCookie); err == nil && c.Value != "" {
+		return "", false
+	}
+	for _, prefix := range publicPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return "", false
+		}
+	}
+	return r.URL.RequestURI(), true
+}
+
+// SessionExpired — 401 от API означает, что сессия Metabase истекла или закрыта.
+func (m *MetabaseBackend) SessionExpired(resp *http.Response) bool {
+	path := resp.Request.URL.Path
+	return resp.StatusCode == http.StatusUnauthorized &&
+		strings.HasPrefix(path, "/api/") && path != "/api/session"
+}
@@ -2,6 +2,7 @@ package metabase
 
 import (
 	"any-oidc-proxy/pkg/backend"
+	"any-oidc-proxy/pkg/logging"
 	oidcauth "any-oidc-proxy/pkg/oidc"
 	"context"
 	"errors"
@@ -9,16 +10,20 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
-
-	log "github.com/sirupsen/logrus"
 )
 
 type MetabaseBackend struct {
-	client *ClientOIDC
+	client        *ClientOIDC
+	roles         backend.RoleMapping
+	sessionCookie string
+	credentials   *backend.Credentials
+	protection    backend.Protection
+	identities    backend.Identities
 }
 
-func NewMetabaseBackend(baseURL, adminEmail, adminPassword string, httpClient *http.Client) (*MetabaseBackend, error) {
+func NewMetabaseBackend(baseURL, adminEmail, adminPassword string, httpClient *http.Client, opts backend.Options) (*MetabaseBackend, error) {
 	u, err := url.Parse(baseURL)
 	if err != nil {
 		return nil, fmt.Errorf("invalid base URL: %w", err)
@@ -33,42 +38,101 @@ func NewMetabaseBackend(baseURL, adminEmail, adminPassword string, httpClient *h
 	}
 
 	return &MetabaseBackend{
-		client: client,
+		client:        client,
+		roles:         opts.Roles,
+		sessionCookie: opts.SessionCookie,
+		credentials:   opts.Credentials,
+		protection:    opts.Protection.WithEmails(adminEmail),
+		identities:    opts.Identities,
 	}, nil
 }
 
 func (m *MetabaseBackend) ProvisionUser(ctx context.Context, user backend.UserData) (string, error) {
-	randomPwd := oidcauth.GenPassword(24)
-	userExternal, err := m.client.FindOrCreateUser(ctx, user.Email, user.FirstName, user.LastName, randomPwd)
+	userExternal, err := m.linkedUser(ctx, user)
 	if err != nil {
-		log.Printf("metabase provision error: %v", err)
+		logging.FromContext(ctx).Errorf("metabase identity lookup error: %v", err)
 		return "", errors.New("metabase provision failed")
 	}
-	_ = m.client.UpdateUser(ctx, userExternal.ID, map[string]any{
+	if userExternal == nil {
+		randomPwd := oidcauth.GenPassword(24)
+		userExternal, err = m.client.FindOrCreateUser(ctx, user.Email, user.FirstName, user.LastName, randomPwd)
+		if err != nil {
+			logging.FromContext(ctx).Errorf("metabase provision error: %v", err)
+			return "", errors.New("metabase provision failed")
+		}
+	}
+	// Проверяем до того, как трогать учётную запись
+	if err := m.protection.Check(user, userExternal.IsSuperuser); err != nil {
+		return "", err
+	}
+	accountEmail := user.Email
+	err = m.client.UpdateUser(ctx, userExternal.ID, map[string]any{
 		"email":      user.Email,
 		"first_name": user.FirstName,
 		"last_name":  user.LastName,
 	})
+	if err != nil && !strings.EqualFold(userExternal.Email, user.Email) {
+		logging.FromContext(ctx).Warnf("metabase email change %s -> %s failed: %v", userExternal.Email, user.Email, err)
+		accountEmail = userExternal.Email
+	}
 	_ = m.client.ReactivateUser(ctx, userExternal.ID)
-	return fmt.Sprintf("%d", userExternal.ID), nil
+	userID := strconv.Itoa(userExternal.ID)
+	if err := backend.LinkIdentity(ctx, m.identities, user, backend.Identity{UserID: userID, Email: accountEmail}); err != nil {
+		logging.FromContext(ctx).Warnf("metabase identity link error: %v", err)
+	}
+	if m.roles.Enabled() {
+		if err := m.syncGroups(ctx, userExternal.ID, user.Groups); err != nil {
+			logging.FromContext(ctx).Errorf("metabase group sync error: %v", err)
+			return "", errors.New("metabase group sync failed")
+		}
+	}
+	return userID, nil
+}
+
+// linkedUser возвращает учётную запись, ранее связанную с пользователем IdP, или nil.
+func (m *MetabaseBackend) linkedUser(ctx context.Context, user backend.UserData) (*User, error) {
+	link, err := backend.LookupIdentity(ctx, m.identities, user)
+	if err != nil || link == nil {
+		return nil, err
+	}
+	id, err := strconv.Atoi(link.UserID)
+	if err != nil {
+		return nil, nil
+	}
+	return m.client.GetUser(ctx, id)
 }
 
 func (m *MetabaseBackend) Login(ctx context.Context, userID string, userData backend.UserData) ([]string, error) {
-	randomPwd := oidcauth.GenPassword(24)
 	userExternalId, err := strconv.Atoi(userID)
 	if err != nil {
-		log.Fatalf("Error converting string to int: %v", err)
+		logging.FromContext(ctx).Errorf("metabase: invalid user id %q: %v", userID, err)
 		return nil, errors.New("invalid user id")
 	}
-	if err := m.client.ResetPassword(ctx, userExternalId, randomPwd); err != nil {
-		// Best-effort: if reset endpoint differs by version, try update fallback already done internally
-		log.Printf("password reset warning: %v", err)
+
+	email := backend.AccountEmail(ctx, m.identities, userData)
+	setPassword := func(ctx context.Context, password string) error {
+		// Без нового пароля вход с ним заведомо не удастся, а сохранять его нельзя
+		if err := m.client.ResetPassword(ctx, userExternalId, password); err != nil {
+			return fmt.Errorf("password reset: %w", err)
+		}
+		return nil
+	}
+	login := func(ctx context.Context, password string) ([]string, error) {
+		sessionID, setCookies, err := m.client.LoginUser(ctx, email, password)
+		if err == nil && sessionID == "" {
+			err = errors.New("empty session id")
+		}
+		return setCookies, err
 	}
 
-	sessionID, setCookies, err := m.client.LoginUser(ctx, userData.Email, randomPwd)
-	if err != nil || sessionID == "" {
-		log.Printf("metabase login error: %v", err)
+	setCookies, err := m.credentials.Login(ctx, "metabase:"+userID, setPassword, login)
+	if err != nil {
+		logging.FromContext(ctx).Errorf("metabase login error: %v", err)
 		return nil, errors.New("metabase login failed")
 	}
 	return setCookies, nil
 }
+
+func (m *MetabaseBackend) Logout(ctx context.Context, cookies []*http.Cookie) error {
+	return m.client.Logout(ctx, cookies)
+}
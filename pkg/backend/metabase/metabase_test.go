@@ -0,0 +1,113 @@
+package metabase
+
+import (
+	"any-oidc-proxy/pkg/backend"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// fakeMetabase отвечает на поиск, создание и обновление пользователей и считает изменения.
+type fakeMetabase struct {
+	listStatus int
+	users      []User
+	updates    int
+}
+
+func (f *fakeMetabase) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/user":
+		if f.listStatus != 0 {
+			w.WriteHeader(f.listStatus)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(UserData{Data: f.users})
+	case r.Method == http.MethodPost && r.URL.Path == "/api/user":
+		_ = json.NewEncoder(w).Encode(User{ID: 99, Email: "alice@example.com"})
+	case r.Method == http.MethodPut:
+		f.updates++
+		_, _ = w.Write([]byte("{}"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestProvisionUserProtection(t *testing.T) {
+	protection := backend.NewProtection([]string{"alice@example.com"}, "sso-admins")
+	tests := []struct {
+		name      string
+		metabase  *fakeMetabase
+		email     string
+		groups    []string
+		wantID    string
+		wantErr   error
+		wantFail  bool
+		noUpdates bool
+	}{
+		{
+			name:     "regular user",
+			metabase: &fakeMetabase{users: []User{{ID: 7, Email: "bob@example.com"}}},
+			email:    "bob@example.com",
+			wantID:   "7",
+		},
+		{
+			name:     "new user",
+			metabase: &fakeMetabase{},
+			email:    "carol@example.com",
+			wantID:   "99",
+		},
+		{
+			name:      "listed email",
+			metabase:  &fakeMetabase{users: []User{{ID: 1, Email: "alice@example.com"}}},
+			email:     "alice@example.com",
+			wantErr:   backend.ErrProtectedAccount,
+			noUpdates: true,
+		},
+		{
+			name:      "superuser",
+			metabase:  &fakeMetabase{users: []User{{ID: 2, Email: "bob@example.com", IsSuperuser: true}}},
+			email:     "bob@example.com",
+			wantErr:   backend.ErrProtectedAccount,
+			noUpdates: true,
+		},
+		{
+			name:     "superuser with group",
+			metabase: &fakeMetabase{users: []User{{ID: 2, Email: "bob@example.com", IsSuperuser: true}}},
+			email:    "bob@example.com",
+			groups:   []string{"sso-admins"},
+			wantID:   "2",
+		},
+		{
+			name:      "lookup failure",
+			metabase:  &fakeMetabase{listStatus: http.StatusBadGateway},
+			email:     "bob@example.com",
+			wantFail:  true,
+			noUpdates: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MetabaseBackend{client: newTestClient(t, tt.metabase), protection: protection}
+			id, err := m.ProvisionUser(context.Background(), backend.UserData{Email: tt.email, Groups: tt.groups})
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("ProvisionUser() error = %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantFail:
+				if err == nil {
+					t.Fatalf("ProvisionUser() = %s, want error", id)
+				}
+			case err != nil:
+				t.Fatalf("ProvisionUser() error = %v", err)
+			case id != tt.wantID:
+				t.Errorf("ProvisionUser() = %s, want %s", id, tt.wantID)
+			}
+			if tt.noUpdates && tt.metabase.updates != 0 {
+				t.Errorf("account updated %d times, want none", tt.metabase.updates)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package metabase
+
+import (
+	"any-oidc-proxy/pkg/logging"
+	"context"
+	"strconv"
+)
+
+// syncGroups приводит членство пользователя в группах прав Metabase к таблице ролей:
+// добавляет недостающие группы и удаляет управляемые таблицей, которых у пользователя больше нет.
+func (m *MetabaseBackend) syncGroups(ctx context.Context, userID int, idpGroups []string) error {
+	groups, err := m.client.ListGroups(ctx)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]int, len(groups))
+	for _, g := range groups {
+		byName[g.Name] = g.ID
+	}
+
+	wanted := make(map[int]struct{})
+	for _, name := range m.roles.Resolve(idpGroups) {
+		id, ok := byName[name]
+		if !ok {
+			logging.FromContext(ctx).Warnf("metabase group %q from role mapping not found", name)
+			continue
+		}
+		wanted[id] = struct{}{}
+	}
+	managed := make(map[int]struct{})
+	for _, name := range m.roles.Managed() {
+		if id, ok := byName[name]; ok {
+			managed[id] = struct{}{}
+		}
+	}
+
+	memberships, err := m.client.ListMemberships(ctx)
+	if err != nil {
+		return err
+	}
+	current := make(map[int]int)
+	for _, ms := range memberships[strconv.Itoa(userID)] {
+		current[ms.GroupID] = ms.MembershipID
+	}
+
+	for id := range wanted {
+		if _, ok := current[id]; ok {
+			continue
+		}
+		if err := m.client.AddMembership(ctx, id, userID); err != nil {
+			return err
+		}
+	}
+	for id, membershipID := range current {
+		_, isManaged := managed[id]
+		_, isWanted := wanted[id]
+		if isManaged && !isWanted {
+			if err := m.client.RemoveMembership(ctx, membershipID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
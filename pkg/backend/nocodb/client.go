@@ -1,6 +1,9 @@
 package nocodb
 
 import (
+	"any-oidc-proxy/pkg/backend"
+	"any-oidc-proxy/pkg/metrics"
+	"any-oidc-proxy/pkg/tracing"
 	"context"
 	"encoding/json"
 	"errors"
@@ -11,6 +14,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type ClientOIDC struct {
@@ -47,7 +52,7 @@ type ResetPasswordToken struct {
 	ResetPasswordToken string `json:"reset_password_token"`
 }
 
-func (c *ClientOIDC) ensureAdmin(ctx context.Context) error {
+func (c *ClientOIDC) ensureAdmin(ctx context.Context) (err error) {
 	c.AdminTokenMu.Lock()
 	defer c.AdminTokenMu.Unlock()
 
@@ -55,6 +60,9 @@ func (c *ClientOIDC) ensureAdmin(ctx context.Context) error {
 	if c.AdminToken != "" && time.Now().Before(c.AdminTokenExp) {
 		return nil
 	}
+	defer func() { metrics.AdminSessionRefresh("nocodb", err) }()
+	ctx, span := tracing.Start(ctx, "nocodb.adminLogin")
+	defer func() { tracing.End(span, err) }()
 
 	// Login to get admin token
 	loginURL := c.BaseURL.ResolveReference(&url.URL{Path: "/api/v1/auth/user/signin"})
@@ -96,7 +104,13 @@ func (c *ClientOIDC) doJSON(
 	method string,
 	urlPath *url.URL,
 	in any,
-) (*http.Response, error) {
+) (resp *http.Response, err error) {
+	ctx, span := tracing.Start(ctx, "nocodb.doJSON",
+		attribute.String("http.request.method", method),
+		attribute.String("url.path", urlPath.Path),
+	)
+	defer func() { tracing.End(span, err) }()
+
 	if err := c.ensureAdmin(ctx); err != nil {
 		return nil, err
 	}
@@ -112,7 +126,7 @@ func (c *ClientOIDC) doJSON(
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("xc-auth", c.AdminToken)
 
-	resp, err := c.HTTP.Do(req)
+	resp, err = c.HTTP.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -170,8 +184,9 @@ func (c *ClientOIDC) FindUserByEmail(ctx context.Context, email string) (*User,
 		return nil, err
 	}
 
-	if users == nil || len(users.List) == 0 {
-		return nil, errors.New("no users found")
+	// Не найден — не ошибка: nil, как и при отсутствии точного совпадения email
+	if users == nil {
+		return nil, nil
 	}
 
 	for _, u := range users.List {
@@ -183,13 +198,13 @@ func (c *ClientOIDC) FindUserByEmail(ctx context.Context, email string) (*User,
 	return nil, nil
 }
 
-func (c *ClientOIDC) CreateUser(ctx context.Context, email, first, last, password string) (*User, error) {
+func (c *ClientOIDC) CreateUser(ctx context.Context, email, first, last, password, role string) (*User, error) {
 	body := map[string]any{
 		"email":     email,
 		"firstname": first,
 		"lastname":  last,
 		"password":  password,
-		"roles":     "org-level-creator",
+		"roles":     role,
 	}
 
 	resp, err := c.doJSON(ctx, http.MethodPost, &url.URL{Path: "/api/v1/users"}, body)
@@ -211,6 +226,23 @@ func (c *ClientOIDC) CreateUser(ctx context.Context, email, first, last, passwor
 	return &user, nil
 }
 
+func (c *ClientOIDC) UpdateUserRoles(ctx context.Context, id, role string) error {
+	body := map[string]any{
+		"roles": role,
+	}
+	resp, err := c.doJSON(ctx, http.MethodPatch, &url.URL{Path: "/api/v1/users/" + id}, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("update user roles failed: %s", strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
 func (c *ClientOIDC) PasswordGenerateResetUrl(ctx context.Context, id string) (*ResetPasswordToken, error) {
 	path := &url.URL{Path: "/api/v1/users/" + id + "/generate-reset-url"}
 	resp, err := c.doJSON(ctx, http.MethodPost, path, nil)
@@ -250,16 +282,23 @@ func (c *ClientOIDC) PasswordSet(ctx context.Context, token *ResetPasswordToken,
 	return nil
 }
 
-func (c *ClientOIDC) FindOrCreateUser(ctx context.Context, email, first, last, password string) (*User, error) {
-	u, _ := c.FindUserByEmail(ctx, email)
+func (c *ClientOIDC) FindOrCreateUser(ctx context.Context, email, first, last, password, role string) (*User, error) {
+	// Сбой поиска не означает, что пользователя нет: иначе заведётся дубль и навсегда привяжется к IdP
+	u, err := c.FindUserByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
 	if u != nil {
 		return u, nil
 	}
 
-	return c.CreateUser(ctx, email, first, last, password)
+	return c.CreateUser(ctx, email, first, last, password, role)
 }
 
 func (c *ClientOIDC) LoginUser(ctx context.Context, email, password string) (token string, setCookies []string, err error) {
+	ctx, span := tracing.Start(ctx, "nocodb.LoginUser")
+	defer func() { tracing.End(span, err) }()
+
 	loginURL := c.BaseURL.ResolveReference(&url.URL{Path: "/api/v1/auth/user/signin"})
 	body := map[string]string{
 		"email":    email,
@@ -276,6 +315,10 @@ func (c *ClientOIDC) LoginUser(ctx context.Context, email, password string) (tok
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		b, _ := io.ReadAll(resp.Body)
+		return "", nil, fmt.Errorf("user login failed: %w: %s", backend.ErrInvalidCredentials, strings.TrimSpace(string(b)))
+	}
 	if resp.StatusCode != 200 {
 		b, _ := io.ReadAll(resp.Body)
 		return "", nil, fmt.Errorf("user login failed: %s", strings.TrimSpace(string(b)))
@@ -288,3 +331,51 @@ func (c *ClientOIDC) LoginUser(ctx context.Context, email, password string) (tok
 
 	return authResp.Token, resp.Header.Values("Set-Cookie"), nil
 }
+
+// RefreshToken получает токен пользователя по refresh_token куке браузера.
+func (c *ClientOIDC) RefreshToken(ctx context.Context, cookies []*http.Cookie) (string, error) {
+	u := c.BaseURL.ResolveReference(&url.URL{Path: "/api/v1/auth/token/refresh"})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("refresh token failed: %s", strings.TrimSpace(string(b)))
+	}
+
+	var authResp AuthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&authResp); err != nil {
+		return "", err
+	}
+	return authResp.Token, nil
+}
+
+// SignOut отзывает refresh token пользователя.
+func (c *ClientOIDC) SignOut(ctx context.Context, token string, cookies []*http.Cookie) error {
+	u := c.BaseURL.ResolveReference(&url.URL{Path: "/api/v1/auth/user/signout"})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), nil)
+	req.Header.Set("xc-auth", token)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("sign out failed: %s", strings.TrimSpace(string(b)))
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package nocodb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNocoDB отвечает на поиск и создание пользователей.
+type fakeNocoDB struct {
+	listStatus int
+	users      []User
+	created    int
+}
+
+func (f *fakeNocoDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1/users":
+		if f.listStatus != 0 {
+			w.WriteHeader(f.listStatus)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(UserList{List: f.users})
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/users":
+		f.created++
+		_ = json.NewEncoder(w).Encode(User{ID: "new", Email: "alice@example.com"})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// newTestClient — клиент к фейковому NocoDB с уже полученным админским токеном.
+func newTestClient(t *testing.T, h http.Handler) *ClientOIDC {
+	t.Helper()
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	base, _ := url.Parse(server.URL)
+	return &ClientOIDC{
+		BaseURL:       base,
+		HTTP:          server.Client(),
+		AdminToken:    "admin-token",
+		AdminTokenMu:  &sync.Mutex{},
+		AdminTokenExp: time.Now().Add(time.Hour),
+	}
+}
+
+func TestFindOrCreateUser(t *testing.T) {
+	tests := []struct {
+		name        string
+		nocodb      *fakeNocoDB
+		wantID      string
+		wantCreated int
+		wantErr     bool
+	}{
+		{name: "existing user", nocodb: &fakeNocoDB{users: []User{{ID: "u1", Email: "Alice@Example.com"}}}, wantID: "u1"},
+		{name: "new user", nocodb: &fakeNocoDB{users: []User{{ID: "u2", Email: "alice.smith@example.com"}}}, wantID: "new", wantCreated: 1},
+		{name: "lookup failure", nocodb: &fakeNocoDB{listStatus: http.StatusBadGateway}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, tt.nocodb)
+			u, err := c.FindOrCreateUser(context.Background(), "alice@example.com", "Alice", "", "password", "org-level-viewer")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FindOrCreateUser() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && u.ID != tt.wantID {
+				t.Errorf("FindOrCreateUser() = %s, want %s", u.ID, tt.wantID)
+			}
+			if tt.nocodb.created != tt.wantCreated {
+				t.Errorf("created %d users, want %d", tt.nocodb.created, tt.wantCreated)
+			}
+		})
+	}
+}
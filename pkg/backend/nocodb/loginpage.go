@@ -0,0 +1,26 @@
+package nocodb
+
+import (
+	"net/http"
+)
+
+// LoginRedirect распознаёт вход в NocoDB. Маршрут /#/signin живёт во фрагменте URL и на сервер
+// не попадает, поэтому входом считается открытие приложения без refresh_token куки.
+func (m *NocodbBackend) LoginRedirect(r *http.Request) (string, bool) {
+	switch r.URL.Path {
+	case "/", "/dashboard", "/dashboard/":
+	default:
+		return "", false
+	}
+	if c, err := r.Cookie(RefreshCookieName); err == nil && c.Value != "" {
+		return "", false
+	}
+	return r.URL.RequestURI(), true
+}
+
+// SessionExpired — фронтенд NocoDB сам обновляет короткий токен по refresh_token,
+// поэтому сессия истекла, только когда отказал сам refresh.
+func (m *NocodbBackend) SessionExpired(resp *http.Response) bool {
+	return resp.Request.URL.Path == "/api/v1/auth/token/refresh" &&
+		(resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusBadRequest)
+}
@@ -2,22 +2,32 @@ package nocodb
 
 import (
 	"any-oidc-proxy/pkg/backend"
+	"any-oidc-proxy/pkg/logging"
 	oidcauth "any-oidc-proxy/pkg/oidc"
 	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
-
-	log "github.com/sirupsen/logrus"
 )
 
+// RefreshCookieName — кука, по которой фронтенд NocoDB получает токен сессии
+const RefreshCookieName = "refresh_token"
+
 type NocodbBackend struct {
-	client *ClientOIDC
+	client      *ClientOIDC
+	roles       backend.RoleMapping
+	defaultRole string
+	credentials *backend.Credentials
+	protection  backend.Protection
+	identities  backend.Identities
 }
 
-func NewNocodbBackend(baseURL, adminEmail, adminPassword string, httpClient *http.Client) (*NocodbBackend, error) {
+// NewNocodbBackend создаёт бэкенд NocoDB. defaultRole — org-роль для пользователей,
+// которым таблица ролей ничего не сопоставила (или если таблица не задана).
+func NewNocodbBackend(baseURL, adminEmail, adminPassword, defaultRole string, httpClient *http.Client, opts backend.Options) (*NocodbBackend, error) {
 	u, err := url.Parse(baseURL)
 	if err != nil {
 		return nil, fmt.Errorf("invalid base URL: %w", err)
@@ -31,37 +41,124 @@ func NewNocodbBackend(baseURL, adminEmail, adminPassword string, httpClient *htt
 		AdminTokenMu:  &sync.Mutex{},
 	}
 
+	if defaultRole == "" {
+		defaultRole = "org-level-creator"
+	}
+
 	return &NocodbBackend{
-		client: client,
+		client:      client,
+		roles:       opts.Roles,
+		defaultRole: defaultRole,
+		credentials: opts.Credentials,
+		protection:  opts.Protection.WithEmails(adminEmail),
+		identities:  opts.Identities,
 	}, nil
 }
 
 func (m *NocodbBackend) ProvisionUser(ctx context.Context, user backend.UserData) (string, error) {
-	randomPwd := oidcauth.GenPassword(24)
-	userExternal, err := m.client.FindOrCreateUser(ctx, user.Email, user.FirstName, user.LastName, randomPwd)
+	role := m.orgRole(user.Groups)
+	userExternal, err := m.linkedUser(ctx, user)
 	if err != nil {
-		log.Printf("nocodb provision error: %v", err)
+		logging.FromContext(ctx).Errorf("nocodb identity lookup error: %v", err)
 		return "", errors.New("nocodb provision failed")
 	}
+	if userExternal == nil {
+		randomPwd := oidcauth.GenPassword(24)
+		userExternal, err = m.client.FindOrCreateUser(ctx, user.Email, user.FirstName, user.LastName, randomPwd, role)
+		if err != nil {
+			logging.FromContext(ctx).Errorf("nocodb provision error: %v", err)
+			return "", errors.New("nocodb provision failed")
+		}
+	} else if !strings.EqualFold(userExternal.Email, user.Email) {
+		// API NocoDB не позволяет сменить email пользователя: входим в прежнюю учётную запись
+		logging.FromContext(ctx).Warnf("nocodb: IdP email of %s changed to %s, keeping linked account", userExternal.Email, user.Email)
+	}
+	// Владелец инстанса (super) считается администратором
+	if err := m.protection.Check(user, strings.Contains(userExternal.Roles, "super")); err != nil {
+		return "", err
+	}
+	// Владельца инстанса (super) не понижаем
+	if m.roles.Enabled() && userExternal.Roles != role && !strings.Contains(userExternal.Roles, "super") {
+		if err := m.client.UpdateUserRoles(ctx, userExternal.ID, role); err != nil {
+			logging.FromContext(ctx).Errorf("nocodb role sync error: %v", err)
+			return "", errors.New("nocodb role sync failed")
+		}
+	}
+	link := backend.Identity{UserID: userExternal.ID, Email: userExternal.Email}
+	if err := backend.LinkIdentity(ctx, m.identities, user, link); err != nil {
+		logging.FromContext(ctx).Warnf("nocodb identity link error: %v", err)
+	}
 	return userExternal.ID, nil
 }
 
-func (m *NocodbBackend) Login(ctx context.Context, userID string, userData backend.UserData) ([]string, error) {
-	randomPwd := oidcauth.GenPassword(24)
-	token, err := m.client.PasswordGenerateResetUrl(ctx, userID)
-	if err != nil {
-		log.Printf("nocodb password reset error: %v", err)
-		return nil, errors.New("nocodb password reset error")
+// linkedUser возвращает учётную запись, ранее связанную с пользователем IdP, или nil.
+// Поиска по id в API нет, поэтому ищем по запомненному email и сверяем id.
+func (m *NocodbBackend) linkedUser(ctx context.Context, user backend.UserData) (*User, error) {
+	link, err := backend.LookupIdentity(ctx, m.identities, user)
+	if err != nil || link == nil {
+		return nil, err
 	}
-	err = m.client.PasswordSet(ctx, token, randomPwd)
+	u, err := m.client.FindUserByEmail(ctx, link.Email)
 	if err != nil {
-		log.Printf("nocodb password set error: %v", err)
-		return nil, errors.New("nocodb password set error")
+		return nil, err
+	}
+	if u == nil || u.ID != link.UserID {
+		return nil, nil
+	}
+	return u, nil
+}
+
+// orgRole выбирает org-роль по таблице ролей: NocoDB допускает одну роль, поэтому побеждает первая подходящая запись.
+func (m *NocodbBackend) orgRole(groups []string) string {
+	if resolved := m.roles.Resolve(groups); len(resolved) > 0 {
+		return resolved[0]
 	}
-	sessionID, setCookies, err := m.client.LoginUser(ctx, userData.Email, randomPwd)
-	if err != nil || sessionID == "" {
-		log.Printf("nocodb login error: %v", err)
+	return m.defaultRole
+}
+
+func (m *NocodbBackend) Login(ctx context.Context, userID string, userData backend.UserData) ([]string, error) {
+	setPassword := func(ctx context.Context, password string) error {
+		token, err := m.client.PasswordGenerateResetUrl(ctx, userID)
+		if err != nil {
+			logging.FromContext(ctx).Errorf("nocodb password reset error: %v", err)
+			return errors.New("nocodb password reset error")
+		}
+		if err := m.client.PasswordSet(ctx, token, password); err != nil {
+			logging.FromContext(ctx).Errorf("nocodb password set error: %v", err)
+			return errors.New("nocodb password set error")
+		}
+		return nil
+	}
+	email := backend.AccountEmail(ctx, m.identities, userData)
+	login := func(ctx context.Context, password string) ([]string, error) {
+		sessionID, setCookies, err := m.client.LoginUser(ctx, email, password)
+		if err == nil && sessionID == "" {
+			err = errors.New("empty session id")
+		}
+		return setCookies, err
+	}
+
+	setCookies, err := m.credentials.Login(ctx, "nocodb:"+userID, setPassword, login)
+	if err != nil {
+		logging.FromContext(ctx).Errorf("nocodb login error: %v", err)
 		return nil, errors.New("metabase login failed")
 	}
 	return setCookies, nil
 }
+
+func (m *NocodbBackend) Logout(ctx context.Context, cookies []*http.Cookie) error {
+	var refresh []*http.Cookie
+	for _, c := range cookies {
+		if c.Name == RefreshCookieName {
+			refresh = append(refresh, c)
+		}
+	}
+	if len(refresh) == 0 {
+		return nil
+	}
+	token, err := m.client.RefreshToken(ctx, refresh)
+	if err != nil {
+		return err
+	}
+	return m.client.SignOut(ctx, token, refresh)
+}
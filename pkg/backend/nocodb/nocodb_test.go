@@ -0,0 +1,83 @@
+package nocodb
+
+import (
+	"any-oidc-proxy/pkg/backend"
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestProvisionUserProtection(t *testing.T) {
+	protection := backend.NewProtection([]string{"alice@example.com"}, "sso-admins")
+	tests := []struct {
+		name     string
+		nocodb   *fakeNocoDB
+		email    string
+		groups   []string
+		wantID   string
+		wantErr  error
+		wantFail bool
+	}{
+		{
+			name:   "regular user",
+			nocodb: &fakeNocoDB{users: []User{{ID: "u1", Email: "bob@example.com", Roles: "org-level-creator"}}},
+			email:  "bob@example.com",
+			wantID: "u1",
+		},
+		{
+			name:    "listed email",
+			nocodb:  &fakeNocoDB{users: []User{{ID: "u1", Email: "alice@example.com", Roles: "org-level-viewer"}}},
+			email:   "alice@example.com",
+			wantErr: backend.ErrProtectedAccount,
+		},
+		{
+			name:    "super",
+			nocodb:  &fakeNocoDB{users: []User{{ID: "u2", Email: "bob@example.com", Roles: "super"}}},
+			email:   "bob@example.com",
+			wantErr: backend.ErrProtectedAccount,
+		},
+		{
+			name:    "super among org roles",
+			nocodb:  &fakeNocoDB{users: []User{{ID: "u2", Email: "bob@example.com", Roles: "org-level-creator,super"}}},
+			email:   "bob@example.com",
+			wantErr: backend.ErrProtectedAccount,
+		},
+		{
+			name:   "super with group",
+			nocodb: &fakeNocoDB{users: []User{{ID: "u2", Email: "bob@example.com", Roles: "super"}}},
+			email:  "bob@example.com",
+			groups: []string{"sso-admins"},
+			wantID: "u2",
+		},
+		{
+			name:     "lookup failure",
+			nocodb:   &fakeNocoDB{listStatus: http.StatusBadGateway},
+			email:    "bob@example.com",
+			wantFail: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &NocodbBackend{client: newTestClient(t, tt.nocodb), defaultRole: "org-level-creator", protection: protection}
+			id, err := m.ProvisionUser(context.Background(), backend.UserData{Email: tt.email, Groups: tt.groups})
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("ProvisionUser() error = %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantFail:
+				if err == nil {
+					t.Fatalf("ProvisionUser() = %s, want error", id)
+				}
+			case err != nil:
+				t.Fatalf("ProvisionUser() error = %v", err)
+			case id != tt.wantID:
+				t.Errorf("ProvisionUser() = %s, want %s", id, tt.wantID)
+			}
+			if tt.nocodb.created != 0 {
+				t.Errorf("created %d users, want none", tt.nocodb.created)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package plane
 
 import (
+	"any-oidc-proxy/pkg/backend"
+	"any-oidc-proxy/pkg/tracing"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -17,12 +19,16 @@ type csrfResp struct {
 	CSRFToken string `json:"csrf_token"`
 }
 
-func (pb *PlaneBackend) loginUser(ctx context.Context, email, password string) ([]string, error) {
+func (pb *PlaneBackend) loginUser(ctx context.Context, email, password string) (_ []string, err error) {
+	ctx, span := tracing.Start(ctx, "plane.loginUser")
+	defer func() { tracing.End(span, err) }()
+
 	// CookieJar, чтобы автоматически сохранять и отправлять куки (csrftoken, session и т.д.)
 	jar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
 	client := &http.Client{
-		Jar:     jar,
-		Timeout: pb.httpClient.Timeout,
+		Jar:       jar,
+		Timeout:   pb.httpClient.Timeout,
+		Transport: pb.httpClient.Transport,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse // Disable automatic redirects
 		},
@@ -66,6 +72,14 @@ func (pb *PlaneBackend) loginUser(ctx context.Context, email, password string) (
 	}
 	defer respSign.Body.Close()
 
+	if respSign.StatusCode == http.StatusBadRequest || respSign.StatusCode == http.StatusUnauthorized {
+		b, _ := io.ReadAll(respSign.Body)
+		return []string{}, fmt.Errorf("sign-in: %w: status %d: %s", backend.ErrInvalidCredentials, respSign.StatusCode, string(b))
+	}
+	// Неверный пароль Plane сообщает редиректом на страницу входа с error_code в адресе
+	if loc, err := url.Parse(respSign.Header.Get("Location")); err == nil && loc.Query().Has("error_code") {
+		return []string{}, fmt.Errorf("sign-in: %w: %s", backend.ErrInvalidCredentials, loc.Query().Get("error_message"))
+	}
 	if respSign.StatusCode != http.StatusOK && respSign.StatusCode != http.StatusFound && respSign.StatusCode != http.StatusSeeOther {
 		b, _ := io.ReadAll(respSign.Body)
 		return []string{}, fmt.Errorf("sign-in: status %d: %s", respSign.StatusCode, string(b))
@@ -1,14 +1,23 @@
 package plane
 
 import (
+	"any-oidc-proxy/pkg/backend"
+	"any-oidc-proxy/pkg/logging"
+	oidcauth "any-oidc-proxy/pkg/oidc"
+	"context"
 	"errors"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm/clause"
 )
 
+// pgUndefinedTable — SQLSTATE «таблица не существует»
+const pgUndefinedTable = "42P01"
+
 type User struct {
 	Password          string     `gorm:"column:password;not null"`
 	LastLogin         *time.Time `gorm:"column:last_login"`
@@ -51,17 +60,62 @@ type User struct {
 	MaskedAt          *time.Time `gorm:"column:masked_at"`
 }
 
-func (pb *PlaneBackend) createOrUpdateUser(email, firstName, lastName, randomPwd string) (*User, error) {
-	hashedPwd, err := Generate(randomPwd)
+// hashPassword возвращает Django-хеш пароля, проверив, что он сходится.
+func hashPassword(password string) (string, error) {
+	hashedPwd, err := Generate(password)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	ok, err := Verify(randomPwd, hashedPwd)
+	ok, err := Verify(password, hashedPwd)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	if !ok {
-		return nil, errors.New("invalid password hash")
+		return "", errors.New("invalid password hash")
+	}
+	return hashedPwd, nil
+}
+
+// findUser ищет пользователя Plane: сначала по связи с IdP, затем по email. Возвращает nil, если не найден.
+func (pb *PlaneBackend) findUser(ctx context.Context, link *backend.Identity, email string) (*User, error) {
+	var user User
+	if link != nil {
+		if err := pb.db.WithContext(ctx).Where("id = ?", link.UserID).Limit(1).Find(&user).Error; err != nil {
+			return nil, err
+		}
+		if user.ID != "" {
+			return &user, nil
+		}
+	}
+	if err := pb.db.WithContext(ctx).Where("email = ?", email).Limit(1).Find(&user).Error; err != nil {
+		return nil, err
+	}
+	if user.ID == "" {
+		return nil, nil
+	}
+	return &user, nil
+}
+
+// userByID загружает пользователя по id. Сессии, выданные до связывания по sub,
+// хранят вместо id email — их тоже принимаем.
+func (pb *PlaneBackend) userByID(ctx context.Context, userID string) (*User, error) {
+	column := "id"
+	if _, err := uuid.Parse(userID); err != nil {
+		column = "email"
+	}
+	var user User
+	if err := pb.db.WithContext(ctx).Where(column+" = ?", userID).Take(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// createOrUpdateUser заводит пользователя или обновляет его имя и email. Пароль существующего
+// пользователя не меняется, новому задаётся случайный до первого setPassword.
+func (pb *PlaneBackend) createOrUpdateUser(ctx context.Context, existing *User, email, firstName, lastName string) (*User, error) {
+	hashedPwd, err := hashPassword(oidcauth.GenPassword(24))
+	if err != nil {
+		return nil, err
 	}
 	now := time.Now()
 	tokenGenerated := strings.ReplaceAll(uuid.New().String()+uuid.New().String(), "-", "")
@@ -104,29 +158,97 @@ func (pb *PlaneBackend) createOrUpdateUser(email, firstName, lastName, randomPwd
 		MaskedAt:          nil,
 	}
 
-	// Попробуем найти существующего пользователя
-	_ = pb.db.Where("email = ?", email).Limit(1).Find(&user)
+	if existing != nil {
+		user = *existing
+	}
 
 	if user.ID == "" {
-		// Если пользователь не найден, создаем нового
+		// Если пользователь не найден, создаем нового. ON CONFLICT — на случай, если параллельный
+		// вход с другого экземпляра прокси успел создать его раньше
 		user.ID = uuid.New().String()
-		if err := pb.db.Create(&user).Error; err != nil {
-			return &user, err
+		res := pb.db.WithContext(ctx).Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "email"}},
+			DoNothing: true,
+		}).Create(&user)
+		if res.Error != nil {
+			return &user, res.Error
 		}
-	} else {
-		// Если пользователь найден, обновляем его данные
-		user.FirstName = firstName
-		user.LastName = lastName
-		user.DisplayName = fmt.Sprintf("%s %s", firstName, lastName)
-		user.Password = hashedPwd
-		user.UpdatedAt = time.Now()
-		if user.TokenUpdatedAt == nil || user.Token == "" {
-			user.TokenUpdatedAt = &now
-			user.Token = tokenGenerated
+		if res.RowsAffected > 0 {
+			return &user, nil
+		}
+		existing = &User{}
+		if err := pb.db.WithContext(ctx).Where("email = ?", email).Take(existing).Error; err != nil {
+			return nil, err
+		}
+		user = *existing
+	}
+
+	// Если пользователь найден, обновляем его данные
+	oldEmail := user.Email
+	if !strings.EqualFold(user.Email, email) {
+		user.Email = email
+		user.Username = email
+	}
+	user.FirstName = firstName
+	user.LastName = lastName
+	user.DisplayName = fmt.Sprintf("%s %s", firstName, lastName)
+	user.UpdatedAt = time.Now()
+	if user.TokenUpdatedAt == nil || user.Token == "" {
+		user.TokenUpdatedAt = &now
+		user.Token = tokenGenerated
+	}
+	if err := pb.db.WithContext(ctx).Save(&user).Error; err != nil {
+		if oldEmail == user.Email {
+			return &user, err
 		}
-		if err := pb.db.Save(&user).Error; err != nil {
+		// Новый email уже занят другим пользователем — оставляем прежний
+		logging.FromContext(ctx).Warnf("plane email change %s -> %s failed: %v", oldEmail, email, err)
+		user.Email = oldEmail
+		user.Username = existing.Username
+		if err := pb.db.WithContext(ctx).Save(&user).Error; err != nil {
 			return &user, err
 		}
 	}
 	return &user, nil
 }
+
+// setPassword задаёт пользователю пароль, с которым прокси входит в Plane от его имени.
+func (pb *PlaneBackend) setPassword(ctx context.Context, userID, password string) error {
+	hashedPwd, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return pb.db.WithContext(ctx).Model(&User{}).Where("id = ?", userID).
+		Updates(map[string]any{"password": hashedPwd, "updated_at": time.Now()}).Error
+}
+
+// isPrivileged сообщает, является ли пользователь суперпользователем Plane, администратором
+// инстанса (god-mode) или владельцем workspace. nil — пользователя ещё нет.
+func (pb *PlaneBackend) isPrivileged(ctx context.Context, user *User) (bool, error) {
+	if user == nil {
+		return false, nil
+	}
+	if user.IsSuperuser || user.IsStaff {
+		return true, nil
+	}
+	db := pb.db.WithContext(ctx)
+
+	var admins int64
+	err := db.Table("instance_admins").Where("user_id = ?", user.ID).Count(&admins).Error
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.As(err, &pgErr) && pgErr.Code == pgUndefinedTable:
+		// В старых версиях Plane таблицы нет
+	case err != nil:
+		return false, err
+	case admins > 0:
+		return true, nil
+	}
+
+	var owned int64
+	err = db.Model(&Workspace{}).Where("owner_id = ? AND deleted_at IS NULL", user.ID).Count(&owned).Error
+	if err != nil {
+		return false, err
+	}
+	return owned > 0, nil
+}
@@ -0,0 +1,105 @@
+package plane
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// fakeCounts — драйвер database/sql, отвечающий на запросы count(*) по имени таблицы.
+type fakeCounts struct {
+	counts map[string]int64
+	errs   map[string]error
+}
+
+func (f fakeCounts) Connect(context.Context) (driver.Conn, error) { return f, nil }
+func (f fakeCounts) Driver() driver.Driver                        { return nil }
+
+func (f fakeCounts) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (f fakeCounts) Close() error                        { return nil }
+func (f fakeCounts) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (f fakeCounts) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	for table, err := range f.errs {
+		if strings.Contains(query, `"`+table+`"`) {
+			return nil, err
+		}
+	}
+	for table, n := range f.counts {
+		if strings.Contains(query, `"`+table+`"`) {
+			return &countRows{n: n}, nil
+		}
+	}
+	return &countRows{}, nil
+}
+
+type countRows struct {
+	n    int64
+	done bool
+}
+
+func (r *countRows) Columns() []string { return []string{"count"} }
+func (r *countRows) Close() error      { return nil }
+
+func (r *countRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.n
+	return nil
+}
+
+// newTestPlane — бэкенд Plane поверх фейковой базы.
+func newTestPlane(t *testing.T, db fakeCounts) *PlaneBackend {
+	t.Helper()
+	sqlDB := sql.OpenDB(db)
+	t.Cleanup(func() { sqlDB.Close() })
+	gormDB, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &PlaneBackend{db: gormDB}
+}
+
+func TestIsPrivileged(t *testing.T) {
+	noTable := &pgconn.PgError{Code: pgUndefinedTable}
+	tests := []struct {
+		name    string
+		user    *User
+		db      fakeCounts
+		want    bool
+		wantErr bool
+	}{
+		{name: "new user", user: nil},
+		{name: "regular user", user: &User{ID: "u1"}},
+		{name: "superuser", user: &User{ID: "u1", IsSuperuser: true}, db: fakeCounts{errs: map[string]error{"workspaces": io.ErrUnexpectedEOF}}, want: true},
+		{name: "staff", user: &User{ID: "u1", IsStaff: true}, want: true},
+		{name: "instance admin", user: &User{ID: "u1"}, db: fakeCounts{counts: map[string]int64{"instance_admins": 1}}, want: true},
+		{name: "workspace owner", user: &User{ID: "u1"}, db: fakeCounts{counts: map[string]int64{"workspaces": 2}}, want: true},
+		{name: "no instance_admins table", user: &User{ID: "u1"}, db: fakeCounts{errs: map[string]error{"instance_admins": noTable}}},
+		{name: "no instance_admins table owner", user: &User{ID: "u1"}, db: fakeCounts{errs: map[string]error{"instance_admins": noTable}, counts: map[string]int64{"workspaces": 1}}, want: true},
+		{name: "instance admin lookup failure", user: &User{ID: "u1"}, db: fakeCounts{errs: map[string]error{"instance_admins": io.ErrUnexpectedEOF}}, wantErr: true},
+		{name: "owner lookup failure", user: &User{ID: "u1"}, db: fakeCounts{errs: map[string]error{"workspaces": &pgconn.PgError{Code: "57P01"}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pb := newTestPlane(t, tt.db)
+			got, err := pb.isPrivileged(context.Background(), tt.user)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("isPrivileged() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("isPrivileged() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
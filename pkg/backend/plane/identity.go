@@ -0,0 +1,56 @@
+package plane
+
+import (
+	"any-oidc-proxy/pkg/backend"
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// identityRow — связь пользователя IdP с пользователем Plane, хранится в базе Plane.
+type identityRow struct {
+	Issuer    string    `gorm:"primaryKey;column:issuer"`
+	Subject   string    `gorm:"primaryKey;column:subject"`
+	UserID    string    `gorm:"column:user_id;type:uuid;not null"`
+	Email     string    `gorm:"column:email;not null"`
+	UpdatedAt time.Time `gorm:"column:updated_at;not null"`
+}
+
+func (identityRow) TableName() string {
+	return "oidc_identities"
+}
+
+// dbIdentities реализует backend.Identities поверх базы Plane.
+type dbIdentities struct {
+	db *gorm.DB
+}
+
+func newDBIdentities(db *gorm.DB) (*dbIdentities, error) {
+	if err := db.AutoMigrate(&identityRow{}); err != nil {
+		return nil, err
+	}
+	return &dbIdentities{db: db}, nil
+}
+
+func (d *dbIdentities) Lookup(ctx context.Context, issuer, subject string) (*backend.Identity, error) {
+	var row identityRow
+	err := d.db.WithContext(ctx).Where("issuer = ? AND subject = ?", issuer, subject).Take(&row).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &backend.Identity{UserID: row.UserID, Email: row.Email}, nil
+}
+
+func (d *dbIdentities) Link(ctx context.Context, issuer, subject string, id backend.Identity) error {
+	row := identityRow{Issuer: issuer, Subject: subject, UserID: id.UserID, Email: id.Email, UpdatedAt: time.Now()}
+	return d.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "issuer"}, {Name: "subject"}},
+		DoUpdates: clause.AssignmentColumns([]string{"user_id", "email", "updated_at"}),
+	}).Create(&row).Error
+}
@@ -0,0 +1,37 @@
+package plane
+
+import (
+	"net/http"
+	"strings"
+)
+
+// publicPrefixes — разделы Plane со своей авторизацией или доступные без сессии.
+var publicPrefixes = []string{"/god-mode/", "/spaces/", "/accounts/", "/auth/", "/api/", "/_next/"}
+
+// LoginRedirect распознаёт страницу входа Plane (корень и /sign-in с next_path), а также
+// любую навигацию без сессии: на неё Plane отвечает клиентским переходом на форму входа.
+func (pb *PlaneBackend) LoginRedirect(r *http.Request) (string, bool) {
+	if c, err := r.Cookie(SessionCookieName); err == nil && c.Value != "" {
+		return "", false
+	}
+
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "", "/sign-in", "/accounts/sign-in":
+		rd := r.URL.Query().Get("next_path")
+		if rd == "" {
+			rd = "/"
+		}
+		return rd, true
+	}
+	for _, prefix := range publicPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return "", false
+		}
+	}
+	return r.URL.RequestURI(), true
+}
+
+// SessionExpired — 401 от API означает, что Django-сессия Plane истекла или удалена.
+func (pb *PlaneBackend) SessionExpired(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusUnauthorized && strings.HasPrefix(resp.Request.URL.Path, "/api/")
+}
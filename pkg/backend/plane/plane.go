@@ -2,54 +2,118 @@ package plane
 
 import (
 	"any-oidc-proxy/pkg/backend"
-	oidcauth "any-oidc-proxy/pkg/oidc"
+	"any-oidc-proxy/pkg/logging"
 	"context"
 	"net/http"
 
-	log "github.com/sirupsen/logrus"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
+// SessionCookieName — кука Django-сессии Plane
+const SessionCookieName = "session-id"
+
 type PlaneBackend struct {
-	db         *gorm.DB
-	baseURL    string
-	httpClient *http.Client
+	db          *gorm.DB
+	baseURL     string
+	httpClient  *http.Client
+	roles       backend.RoleMapping
+	credentials *backend.Credentials
+	protection  backend.Protection
+	identities  backend.Identities
 }
 
-// NewPlaneBackend инициализирует соединение с базой данных.
-func NewPlaneBackend(baseURL string, dsn string, httpClient *http.Client) (*PlaneBackend, error) {
+// NewPlaneBackend инициализирует соединение с базой данных. Связи пользователей IdP
+// с пользователями Plane хранятся в той же базе, opts.Identities не используется.
+func NewPlaneBackend(baseURL string, dsn string, httpClient *http.Client, opts backend.Options) (*PlaneBackend, error) {
+	// Ошибку в ROLE_MAPPING лучше увидеть при старте, а не при первом логине
+	for _, role := range opts.Roles.Managed() {
+		if _, _, err := parseWorkspaceRole(role); err != nil {
+			return nil, err
+		}
+	}
 	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{}) // или используйте другой драйвер
 	if err != nil {
 		return nil, err
 	}
+	if err := traceQueries(db); err != nil {
+		return nil, err
+	}
+	identities, err := newDBIdentities(db)
+	if err != nil {
+		return nil, err
+	}
 	return &PlaneBackend{
-		db:         db,
-		baseURL:    baseURL,
-		httpClient: httpClient,
+		db:          db,
+		baseURL:     baseURL,
+		httpClient:  httpClient,
+		roles:       opts.Roles,
+		credentials: opts.Credentials,
+		protection:  opts.Protection,
+		identities:  identities,
 	}, nil
 }
 
 func (pb *PlaneBackend) ProvisionUser(ctx context.Context, user backend.UserData) (string, error) {
-	return user.Email, nil
+	link, err := backend.LookupIdentity(ctx, pb.identities, user)
+	if err != nil {
+		return "", err
+	}
+	existing, err := pb.findUser(ctx, link, user.Email)
+	if err != nil {
+		return "", err
+	}
+	privileged, err := pb.isPrivileged(ctx, existing)
+	if err != nil {
+		return "", err
+	}
+	if err := pb.protection.Check(user, privileged); err != nil {
+		return "", err
+	}
+	planeUser, err := pb.createOrUpdateUser(ctx, existing, user.Email, user.FirstName, user.LastName)
+	if err != nil {
+		return "", err
+	}
+	if err := backend.LinkIdentity(ctx, pb.identities, user, backend.Identity{UserID: planeUser.ID, Email: planeUser.Email}); err != nil {
+		logging.FromContext(ctx).Warnf("plane identity link error: %v", err)
+	}
+	return planeUser.ID, nil
 }
 
 func (pb *PlaneBackend) Login(ctx context.Context, userID string, userData backend.UserData) ([]string, error) {
-	randomPwd := oidcauth.GenPassword(24)
-	_, err := pb.createOrUpdateUser(
-		userData.Email,
-		userData.FirstName,
-		userData.LastName,
-		randomPwd,
-	)
+	user, err := pb.userByID(ctx, userID)
 	if err != nil {
 		return []string{}, err
 	}
-	log.Debugf("user: %s password: %s", userData.Email, randomPwd)
-	cookies, err := pb.loginUser(ctx, userData.Email, randomPwd)
+	if pb.roles.Enabled() {
+		if err := pb.syncWorkspaces(ctx, user.ID, userData.Groups); err != nil {
+			logging.FromContext(ctx).Errorf("plane workspace sync error: %v", err)
+			return []string{}, err
+		}
+	}
+	setPassword := func(ctx context.Context, password string) error {
+		return pb.setPassword(ctx, user.ID, password)
+	}
+	login := func(ctx context.Context, password string) ([]string, error) {
+		return pb.loginUser(ctx, user.Email, password)
+	}
+	cookies, err := pb.credentials.Login(ctx, "plane:"+user.ID, setPassword, login)
 	if err != nil {
-		log.Infof("Error on login user %+v", err)
+		logging.FromContext(ctx).Errorf("plane login error: %v", err)
 		return []string{}, err
 	}
 	return cookies, nil
 }
+
+// Logout удаляет Django-сессию из базы Plane.
+func (pb *PlaneBackend) Logout(ctx context.Context, cookies []*http.Cookie) error {
+	for _, c := range cookies {
+		if c.Name != SessionCookieName || c.Value == "" {
+			continue
+		}
+		if err := pb.db.WithContext(ctx).Exec("DELETE FROM django_session WHERE session_key = ?", c.Value).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
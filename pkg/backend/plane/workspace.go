@@ -0,0 +1,136 @@
+package plane
+
+import (
+	"any-oidc-proxy/pkg/logging"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Роли участника workspace в Plane
+var workspaceRoles = map[string]int{
+	"admin":  20,
+	"member": 15,
+	"guest":  5,
+}
+
+type Workspace struct {
+	ID   string `gorm:"primaryKey;column:id;type:uuid"`
+	Slug string `gorm:"column:slug"`
+}
+
+func (Workspace) TableName() string {
+	return "workspaces"
+}
+
+type WorkspaceMember struct {
+	ID           string     `gorm:"primaryKey;column:id;type:uuid"`
+	CreatedAt    time.Time  `gorm:"column:created_at;not null"`
+	UpdatedAt    time.Time  `gorm:"column:updated_at;not null"`
+	WorkspaceID  string     `gorm:"column:workspace_id;type:uuid;not null"`
+	MemberID     string     `gorm:"column:member_id;type:uuid;not null"`
+	Role         int        `gorm:"column:role;not null"`
+	ViewProps    string     `gorm:"column:view_props;type:jsonb;not null"`
+	DefaultProps string     `gorm:"column:default_props;type:jsonb;not null"`
+	IssueProps   string     `gorm:"column:issue_props;type:jsonb;not null"`
+	IsActive     bool       `gorm:"column:is_active;not null"`
+	DeletedAt    *time.Time `gorm:"column:deleted_at"`
+}
+
+func (WorkspaceMember) TableName() string {
+	return "workspace_members"
+}
+
+// parseWorkspaceRole разбирает роль из таблицы ролей в формате "<workspace-slug>:<admin|member|guest|число>".
+func parseWorkspaceRole(role string) (string, int, error) {
+	slug, name, ok := strings.Cut(role, ":")
+	if !ok || slug == "" {
+		return "", 0, fmt.Errorf("invalid plane role %q: expected workspace-slug:role", role)
+	}
+	if level, ok := workspaceRoles[strings.ToLower(name)]; ok {
+		return slug, level, nil
+	}
+	level, err := strconv.Atoi(name)
+	if err != nil || level <= 0 {
+		return "", 0, fmt.Errorf("invalid plane role %q: unknown role %q", role, name)
+	}
+	return slug, level, nil
+}
+
+// syncWorkspaces приводит членство пользователя в workspace к таблице ролей:
+// выдаёт наибольшую сопоставленную роль и деактивирует членство в управляемых workspace без роли.
+func (pb *PlaneBackend) syncWorkspaces(ctx context.Context, userID string, groups []string) error {
+	wanted := make(map[string]int)
+	for _, role := range pb.roles.Resolve(groups) {
+		slug, level, err := parseWorkspaceRole(role)
+		if err != nil {
+			return err
+		}
+		if level > wanted[slug] {
+			wanted[slug] = level
+		}
+	}
+
+	for _, role := range pb.roles.Managed() {
+		slug, _, err := parseWorkspaceRole(role)
+		if err != nil {
+			return err
+		}
+		var ws Workspace
+		if err := pb.db.WithContext(ctx).Where("slug = ? AND deleted_at IS NULL", slug).Limit(1).Find(&ws).Error; err != nil {
+			return err
+		}
+		if ws.ID == "" {
+			logging.FromContext(ctx).Warnf("plane workspace %q from role mapping not found", slug)
+			continue
+		}
+		if err := pb.syncWorkspaceMember(ctx, ws.ID, userID, wanted[slug]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncWorkspaceMember выставляет роль участника; level == 0 означает, что членства быть не должно.
+func (pb *PlaneBackend) syncWorkspaceMember(ctx context.Context, workspaceID, userID string, level int) error {
+	var member WorkspaceMember
+	err := pb.db.WithContext(ctx).Where("workspace_id = ? AND member_id = ? AND deleted_at IS NULL", workspaceID, userID).
+		Limit(1).Find(&member).Error
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	switch {
+	case member.ID == "" && level == 0:
+		return nil
+	case member.ID == "":
+		member = WorkspaceMember{
+			ID:           uuid.New().String(),
+			CreatedAt:    now,
+			UpdatedAt:    now,
+			WorkspaceID:  workspaceID,
+			MemberID:     userID,
+			Role:         level,
+			ViewProps:    "{}",
+			DefaultProps: "{}",
+			IssueProps:   "{}",
+			IsActive:     true,
+		}
+		return pb.db.WithContext(ctx).Create(&member).Error
+	case level == 0:
+		if !member.IsActive {
+			return nil
+		}
+		return pb.db.WithContext(ctx).Model(&member).Updates(map[string]any{"is_active": false, "updated_at": now}).Error
+	default:
+		if member.IsActive && member.Role == level {
+			return nil
+		}
+		return pb.db.WithContext(ctx).Model(&member).Updates(map[string]any{"role": level, "is_active": true, "updated_at": now}).Error
+	}
+}
@@ -0,0 +1,33 @@
+package plane
+
+import "testing"
+
+func TestParseWorkspaceRole(t *testing.T) {
+	tests := []struct {
+		role      string
+		wantSlug  string
+		wantLevel int
+		wantErr   bool
+	}{
+		{role: "eng:admin", wantSlug: "eng", wantLevel: 20},
+		{role: "eng:Member", wantSlug: "eng", wantLevel: 15},
+		{role: "eng:guest", wantSlug: "eng", wantLevel: 5},
+		{role: "eng:10", wantSlug: "eng", wantLevel: 10},
+		{role: "eng", wantErr: true},
+		{role: ":admin", wantErr: true},
+		{role: "eng:owner", wantErr: true},
+		{role: "eng:0", wantErr: true},
+		{role: "eng:-5", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role, func(t *testing.T) {
+			slug, level, err := parseWorkspaceRole(tt.role)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseWorkspaceRole(%q) error = %v, wantErr %v", tt.role, err, tt.wantErr)
+			}
+			if slug != tt.wantSlug || level != tt.wantLevel {
+				t.Errorf("parseWorkspaceRole(%q) = %q, %d; want %q, %d", tt.role, slug, level, tt.wantSlug, tt.wantLevel)
+			}
+		})
+	}
+}
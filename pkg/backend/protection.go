@@ -0,0 +1,53 @@
+package backend
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrProtectedAccount — вход через SSO в защищённую учётную запись запрещён.
+var ErrProtectedAccount = errors.New("sso login to protected account refused")
+
+// Protection защищает администраторские учётные записи бэкенда от входа через SSO: прокси
+// задаёт пароль пользователю с совпавшим email, и без защиты владелец почты в IdP получил бы
+// права администратора. Защищены явно перечисленные адреса и учётные записи, которые бэкенд
+// считает привилегированными; войти в них можно только при наличии группы group, если она задана.
+type Protection struct {
+	emails map[string]struct{}
+	group  string
+}
+
+func NewProtection(emails []string, group string) Protection {
+	p := Protection{emails: make(map[string]struct{}), group: group}
+	for _, email := range emails {
+		if email = strings.ToLower(strings.TrimSpace(email)); email != "" {
+			p.emails[email] = struct{}{}
+		}
+	}
+	return p
+}
+
+// WithEmails добавляет адреса к защищённым, например служебную учётную запись администратора бэкенда.
+func (p Protection) WithEmails(emails ...string) Protection {
+	out := NewProtection(emails, p.group)
+	for email := range p.emails {
+		out.emails[email] = struct{}{}
+	}
+	return out
+}
+
+// Check разрешает вход, если учётная запись не защищена или у пользователя есть нужная группа.
+// privileged — бэкенд сам определил учётную запись как администраторскую.
+func (p Protection) Check(user UserData, privileged bool) error {
+	if _, listed := p.emails[strings.ToLower(user.Email)]; !listed && !privileged {
+		return nil
+	}
+	if p.group != "" {
+		for _, g := range user.Groups {
+			if g == p.group {
+				return nil
+			}
+		}
+	}
+	return ErrProtectedAccount
+}
@@ -0,0 +1,46 @@
+package backend
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestProtectionCheck(t *testing.T) {
+	p := NewProtection([]string{" Admin@Example.com ", ""}, "sso-admins").WithEmails("service@example.com")
+	tests := []struct {
+		name       string
+		protection Protection
+		user       UserData
+		privileged bool
+		wantErr    bool
+	}{
+		{name: "regular user", protection: p, user: UserData{Email: "alice@example.com"}},
+		{name: "listed email", protection: p, user: UserData{Email: "admin@example.com"}, wantErr: true},
+		{name: "listed email case", protection: p, user: UserData{Email: "ADMIN@example.com"}, wantErr: true},
+		{name: "added email", protection: p, user: UserData{Email: "service@example.com"}, wantErr: true},
+		{name: "privileged account", protection: p, user: UserData{Email: "alice@example.com"}, privileged: true, wantErr: true},
+		{name: "group override", protection: p, user: UserData{Email: "admin@example.com", Groups: []string{"dev", "sso-admins"}}},
+		{name: "group override privileged", protection: p, user: UserData{Email: "alice@example.com", Groups: []string{"sso-admins"}}, privileged: true},
+		{name: "other group", protection: p, user: UserData{Email: "admin@example.com", Groups: []string{"admins"}}, wantErr: true},
+		{name: "no override group", protection: NewProtection([]string{"admin@example.com"}, ""), user: UserData{Email: "admin@example.com", Groups: []string{""}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.protection.Check(tt.user, tt.privileged)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrProtectedAccount) {
+				t.Errorf("Check() error = %v, want ErrProtectedAccount", err)
+			}
+		})
+	}
+}
+
+func TestProtectionWithEmailsKeepsOriginal(t *testing.T) {
+	p := NewProtection([]string{"admin@example.com"}, "")
+	_ = p.WithEmails("service@example.com")
+	if err := p.Check(UserData{Email: "service@example.com"}, false); err != nil {
+		t.Errorf("WithEmails changed the original protection: %v", err)
+	}
+}
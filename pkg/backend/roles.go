@@ -0,0 +1,84 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RoleMapping сопоставляет группы IdP ролям целевой системы.
+// Формат роли зависит от бэкенда: имя группы прав в Metabase,
+// org-роль в NocoDB, "<workspace-slug>:<role>" в Plane.
+type RoleMapping struct {
+	rules []roleRule
+}
+
+type roleRule struct {
+	group string
+	roles []string
+}
+
+// ParseRoleMapping разбирает записи вида "group=role1|role2". Порядок записей сохраняется.
+func ParseRoleMapping(entries []string) (RoleMapping, error) {
+	var m RoleMapping
+	for _, entry := range entries {
+		group, roles, ok := strings.Cut(entry, "=")
+		group = strings.TrimSpace(group)
+		if !ok || group == "" {
+			return RoleMapping{}, fmt.Errorf("invalid role mapping entry %q: expected group=role", entry)
+		}
+		rule := roleRule{group: group}
+		for _, role := range strings.Split(roles, "|") {
+			if role = strings.TrimSpace(role); role != "" {
+				rule.roles = append(rule.roles, role)
+			}
+		}
+		if len(rule.roles) == 0 {
+			return RoleMapping{}, fmt.Errorf("invalid role mapping entry %q: no roles", entry)
+		}
+		m.rules = append(m.rules, rule)
+	}
+	return m, nil
+}
+
+// Enabled сообщает, задана ли таблица. Без неё бэкенды не трогают роли пользователей.
+func (m RoleMapping) Enabled() bool {
+	return len(m.rules) > 0
+}
+
+// Resolve возвращает роли для групп пользователя в порядке записей таблицы.
+func (m RoleMapping) Resolve(groups []string) []string {
+	member := make(map[string]struct{}, len(groups))
+	for _, g := range groups {
+		member[g] = struct{}{}
+	}
+	var out []string
+	seen := make(map[string]struct{})
+	for _, rule := range m.rules {
+		if _, ok := member[rule.group]; !ok {
+			continue
+		}
+		for _, role := range rule.roles {
+			if _, dup := seen[role]; !dup {
+				seen[role] = struct{}{}
+				out = append(out, role)
+			}
+		}
+	}
+	return out
+}
+
+// Managed возвращает все роли, упомянутые в таблице. Только их бэкенд вправе отзывать,
+// остальные членства пользователя остаются нетронутыми.
+func (m RoleMapping) Managed() []string {
+	var out []string
+	seen := make(map[string]struct{})
+	for _, rule := range m.rules {
+		for _, role := range rule.roles {
+			if _, dup := seen[role]; !dup {
+				seen[role] = struct{}{}
+				out = append(out, role)
+			}
+		}
+	}
+	return out
+}
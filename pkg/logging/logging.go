@@ -0,0 +1,181 @@
+// Package logging настраивает logrus (уровень, формат, маскирование секретов) и сквозной request ID.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// HeaderRequestID — заголовок, в котором request ID приходит от ingress и уходит в upstream и API бэкенда.
+const HeaderRequestID = "X-Request-ID"
+
+type ctxKey struct{}
+
+// Setup применяет LOG_LEVEL и LOG_FORMAT (text | json) и включает маскирование секретов.
+// cookies — имена сессионных кук, значения которых тоже маскируются.
+func Setup(level, format string, cookies ...string) error {
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid LOG_LEVEL: %w", err)
+	}
+	var formatter log.Formatter
+	switch format {
+	case "", "text":
+		formatter = &log.TextFormatter{FullTimestamp: true}
+	case "json":
+		formatter = &log.JSONFormatter{}
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT: expected text or json")
+	}
+	log.SetLevel(lvl)
+	log.SetFormatter(newRedactor(formatter, cookies))
+	return nil
+}
+
+// Middleware берёт request ID из X-Request-ID или генерирует новый, кладёт его в контекст,
+// в заголовок запроса (его увидит upstream) и в ответ.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(HeaderRequestID)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		r.Header.Set(HeaderRequestID, id)
+		w.Header().Set(HeaderRequestID, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, id)))
+	})
+}
+
+// validRequestID отсекает чужие ID, которые могли бы испортить логи.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestID возвращает request ID из контекста или пустую строку.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKey{}).(string)
+	return id
+}
+
+// WithRequestID переносит request ID в другой контекст, например в фоновый с собственным таймаутом.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// FromContext — логгер с полем request_id, если он есть в контексте.
+func FromContext(ctx context.Context) *log.Entry {
+	if id := RequestID(ctx); id != "" {
+		return log.WithField("request_id", id)
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// Transport передаёт request ID из контекста в запросы к API бэкенда.
+func Transport(next http.RoundTripper) http.RoundTripper {
+	return roundTripper(func(r *http.Request) (*http.Response, error) {
+		if id := RequestID(r.Context()); id != "" && r.Header.Get(HeaderRequestID) == "" {
+			r = r.Clone(r.Context())
+			r.Header.Set(HeaderRequestID, id)
+		}
+		return next.RoundTrip(r)
+	})
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+const redacted = "[REDACTED]"
+
+var (
+	// password=..., access_token=... в тексте сообщения, ошибок и query-строк. Только форма key=value:
+	// слово token в обычном тексте ("failed to verify ID token: oidc: ...") не должно съедать ошибку
+	secretPairs = regexp.MustCompile(`(?i)([\w-]*(?:password|passwd|pwd|secret|token|api[_-]?key)=['"]?)([^\s"',;&]+)`)
+	// "password": "..." в JSON-телах запросов и ответов
+	secretJSON = regexp.MustCompile(`(?i)("[\w-]*(?:password|passwd|pwd|secret|token|api[_-]?key)[\w-]*"\s*:\s*")([^"]*)`)
+	// Заголовки с сессией бэкенда: xc-auth: ..., X-Metabase-Session: ...
+	secretHeaders = regexp.MustCompile(`(?i)\b((?:xc-auth|xc-token|x-metabase-session)\s*:\s*)([^\s"',;]+)`)
+	bearer        = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9\-._~+/]+=*`)
+	jwt           = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	// Ключи полей, значения которых не пишутся никогда
+	secretKeys = []string{"password", "secret", "token", "cookie", "authorization", "session"}
+)
+
+// redactor маскирует секреты в сообщении и полях записи перед форматированием.
+type redactor struct {
+	next    log.Formatter
+	cookies *regexp.Regexp // nil — имена кук не заданы
+}
+
+func newRedactor(next log.Formatter, cookies []string) *redactor {
+	r := &redactor{next: next}
+	var names []string
+	for _, c := range cookies {
+		if c != "" {
+			names = append(names, regexp.QuoteMeta(c))
+		}
+	}
+	if len(names) > 0 {
+		r.cookies = regexp.MustCompile(`((?:` + strings.Join(names, "|") + `)=)[^\s;,"]+`)
+	}
+	return r
+}
+
+func (r *redactor) Format(e *log.Entry) ([]byte, error) {
+	clean := *e
+	clean.Message = r.redact(e.Message)
+	clean.Data = make(log.Fields, len(e.Data))
+	for k, v := range e.Data {
+		clean.Data[k] = v
+		if secretKey(k) {
+			clean.Data[k] = redacted
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			clean.Data[k] = r.redact(v)
+		case error:
+			clean.Data[k] = r.redact(v.Error())
+		}
+	}
+	return r.next.Format(&clean)
+}
+
+func (r *redactor) redact(s string) string {
+	s = secretPairs.ReplaceAllString(s, "${1}"+redacted)
+	s = secretJSON.ReplaceAllString(s, "${1}"+redacted)
+	s = secretHeaders.ReplaceAllString(s, "${1}"+redacted)
+	s = bearer.ReplaceAllString(s, "${1}"+redacted)
+	s = jwt.ReplaceAllString(s, redacted)
+	if r.cookies != nil {
+		s = r.cookies.ReplaceAllString(s, "${1}"+redacted)
+	}
+	return s
+}
+
+func secretKey(k string) bool {
+	k = strings.ToLower(k)
+	for _, s := range secretKeys {
+		if strings.Contains(k, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+// Package metrics — метрики Prometheus прокси.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "oidc_proxy"
+
+var (
+	loginAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "login_attempts_total",
+		Help:      "OIDC callbacks received.",
+	}, []string{"provider"})
+
+	loginSuccesses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "login_successes_total",
+		Help:      "Logins completed with a backend session.",
+	}, []string{"provider"})
+
+	loginDenials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "login_denials_total",
+		Help:      "Logins refused by access checks, by reason.",
+	}, []string{"provider", "reason"})
+
+	idpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "idp_request_duration_seconds",
+		Help:      "Latency of IdP operations: code exchange, ID token verification, userinfo.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"provider", "op", "result"})
+
+	backendDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "backend_operation_duration_seconds",
+		Help:      "Latency of backend user provisioning and login.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "op"})
+
+	backendErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_operation_errors_total",
+		Help:      "Failed backend user provisioning and login calls.",
+	}, []string{"backend", "op"})
+
+	adminRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_admin_session_refreshes_total",
+		Help:      "Admin session logins performed by the backend API clients.",
+	}, []string{"backend", "result"})
+
+	upstreamRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_requests_total",
+		Help:      "Requests proxied to the upstream, by status code.",
+	}, []string{"upstream", "code", "method"})
+
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Latency of requests proxied to the upstream.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"upstream", "code", "method"})
+)
+
+// backendType — метка backend для операций, вызываемых из oidcauth; бэкенд в процессе один.
+var backendType = "unknown"
+
+// SetBackend задаёт тип бэкенда (TYPE) для метрик его операций. Вызывается при старте.
+func SetBackend(name string) {
+	backendType = name
+}
+
+// Handler отдаёт метрики в формате Prometheus.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+func LoginAttempt(provider string) {
+	loginAttempts.WithLabelValues(provider).Inc()
+}
+
+func LoginSuccess(provider string) {
+	loginSuccesses.WithLabelValues(provider).Inc()
+}
+
+// LoginDenied учитывает отказ во входе; reason — короткий код причины (domain, group, policy...).
+func LoginDenied(provider, reason string) {
+	loginDenials.WithLabelValues(provider, reason).Inc()
+}
+
+// ObserveIdP учитывает длительность обращения к IdP, начатого в start.
+func ObserveIdP(provider, op string, start time.Time, err error) {
+	idpDuration.WithLabelValues(provider, op, result(err)).Observe(time.Since(start).Seconds())
+}
+
+// ObserveBackend учитывает длительность и ошибку операции бэкенда, начатой в start.
+func ObserveBackend(op string, start time.Time, err error) {
+	backendDuration.WithLabelValues(backendType, op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		backendErrors.WithLabelValues(backendType, op).Inc()
+	}
+}
+
+// AdminSessionRefresh учитывает вход клиента API бэкенда под администратором.
+func AdminSessionRefresh(backend string, err error) {
+	adminRefreshes.WithLabelValues(backend, result(err)).Inc()
+}
+
+// InstrumentTransport считает запросы к upstream и их длительность по коду ответа.
+func InstrumentTransport(upstream string, next http.RoundTripper) http.RoundTripper {
+	labels := prometheus.Labels{"upstream": upstream}
+	return promhttp.InstrumentRoundTripperCounter(upstreamRequests.MustCurryWith(labels),
+		promhttp.InstrumentRoundTripperDuration(upstreamDuration.MustCurryWith(labels), next))
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
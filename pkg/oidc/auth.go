@@ -2,11 +2,16 @@ package oidcauth
 
 import (
 	"any-oidc-proxy/pkg/backend"
+	"any-oidc-proxy/pkg/logging"
+	"any-oidc-proxy/pkg/metrics"
+	"any-oidc-proxy/pkg/tracing"
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -15,30 +20,84 @@ import (
 	"github.com/google/uuid"
 
 	"github.com/coreos/go-oidc/v3/oidc"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/oauth2"
 )
 
 type OIDCAuthenticator struct {
+	name           string
+	displayName    string
 	config         *oauth2.Config
+	provider       *oidc.Provider
 	verifier       *oidc.IDTokenVerifier
 	backend        backend.Backend
 	cookieManager  backend.CookieManager
 	stateSecret    string
 	stateTTL       time.Duration
+	stateStore     StateStore
 	allowedDomains map[string]struct{}
 	allowedEmails  map[string]struct{}
+	allowedGroups  map[string]struct{}
+	policy         *AccessPolicy
+	redirectHosts  map[string]struct{}
+	pkce           bool
+	secureCookies  bool
+	userInfoMode   string
+	claimMapping   ClaimMapping
+	endSessionURL  string
+	postLogoutURL  string
+	rpLogout       bool
+	logoutBackend  bool
+	logoutVerifier *oidc.IDTokenVerifier
+	sessions       SessionRegistry
+	sessionTTL     time.Duration
+	proxySessions  *ProxySessions
+	userLocks      *UserLocks
+
+	requireEmailVerified bool
+	emailVerifiedExempt  map[string]struct{}
+	// Имя по умолчанию, если IdP не прислал ни имени, ни фамилии
+	defaultFirstName string
+	defaultLastName  string
 }
 
 type Config struct {
+	Name           string // имя провайдера в URL (?provider=, путь callback)
+	DisplayName    string // подпись на странице выбора провайдера
 	IssuerURL      string
 	ClientID       string
 	ClientSecret   string
 	RedirectURL    string
+	ExternalURL    string
 	Scopes         []string
 	StateSecret    string
 	StateTTL       time.Duration
+	StateStore     StateStore // по умолчанию в памяти процесса
 	AllowedDomains []string
 	AllowedEmails  []string
+	AllowedGroups  []string
+	Policy         *AccessPolicy // дополняет списки Allowed*, если задана
+	RedirectHosts  []string      // куда можно вернуть пользователя после логина, помимо ExternalURL
+	PKCE           bool          // S256 code challenge, verifier хранится во временной куке
+	SecureCookies  bool
+	UserInfoMode   string // auto | always | never
+	Claims         ClaimMapping
+	PostLogoutURL  string // post_logout_redirect_uri, по умолчанию ExternalURL
+	RPLogout       bool   // перенаправлять на end_session_endpoint провайдера при выходе
+	LogoutBackend  bool   // завершать сессию бэкенда на сервере при выходе
+	// Sessions — реестр выданных сессий для back-channel logout (nil — выключен), SessionTTL — сколько их помнить
+	Sessions   SessionRegistry
+	SessionTTL time.Duration
+	// ProxySessions — собственная сессия прокси, выдаётся после логина; nil — не выдаётся
+	ProxySessions *ProxySessions
+	// UserLocks сериализует provisioning и вход одного пользователя; по умолчанию свой на провайдера
+	UserLocks *UserLocks
+	// RequireEmailVerified отклоняет токены без email_verified=true, кроме доменов из EmailVerifiedExempt
+	RequireEmailVerified bool
+	EmailVerifiedExempt  []string
+	// Имя по умолчанию, если IdP не прислал ни имени, ни фамилии
+	DefaultFirstName string
+	DefaultLastName  string
 }
 
 func NewOIDCAuthenticator(cfg Config, backend backend.Backend, cookieManager backend.CookieManager) (*OIDCAuthenticator, error) {
@@ -56,10 +115,28 @@ func NewOIDCAuthenticator(cfg Config, backend backend.Backend, cookieManager bac
 		Scopes:       cfg.Scopes,
 	}
 
+	var discovery struct {
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+	}
+	if err := provider.Claims(&discovery); err != nil {
+		return nil, fmt.Errorf("failed to parse provider metadata: %w", err)
+	}
+
+	postLogoutURL := cfg.PostLogoutURL
+	if postLogoutURL == "" {
+		postLogoutURL = cfg.ExternalURL
+	}
+
 	verifier := provider.Verifier(&oidc.Config{
 		ClientID: cfg.ClientID,
 	})
 
+	// logout_token проверяется тем же JWKS, но exp в нём необязателен
+	logoutVerifier := provider.Verifier(&oidc.Config{
+		ClientID:        cfg.ClientID,
+		SkipExpiryCheck: true,
+	})
+
 	allowed := make(map[string]struct{})
 	for _, domain := range cfg.AllowedDomains {
 		allowed[strings.ToLower(domain)] = struct{}{}
@@ -70,136 +147,438 @@ func NewOIDCAuthenticator(cfg Config, backend backend.Backend, cookieManager bac
 		allowedEmails[strings.ToLower(email)] = struct{}{}
 	}
 
+	stateStore := cfg.StateStore
+	if stateStore == nil {
+		stateStore = NewMemoryStateStore()
+	}
+
+	emailVerifiedExempt := make(map[string]struct{})
+	for _, domain := range cfg.EmailVerifiedExempt {
+		emailVerifiedExempt[strings.ToLower(domain)] = struct{}{}
+	}
+
+	userInfoMode := cfg.UserInfoMode
+	if userInfoMode == "" {
+		userInfoMode = UserInfoAuto
+	}
+
+	userLocks := cfg.UserLocks
+	if userLocks == nil {
+		userLocks = NewUserLocks()
+	}
+
+	allowedGroups := make(map[string]struct{})
+	for _, group := range cfg.AllowedGroups {
+		allowedGroups[group] = struct{}{}
+	}
+
 	return &OIDCAuthenticator{
+		name:           cfg.Name,
+		displayName:    cfg.DisplayName,
 		config:         oauthConfig,
+		provider:       provider,
 		verifier:       verifier,
 		backend:        backend,
 		cookieManager:  cookieManager,
 		stateSecret:    cfg.StateSecret,
 		stateTTL:       cfg.StateTTL,
+		stateStore:     stateStore,
 		allowedDomains: allowed,
 		allowedEmails:  allowedEmails,
+		allowedGroups:  allowedGroups,
+		policy:         cfg.Policy,
+		redirectHosts:  newRedirectHosts(cfg.ExternalURL, cfg.RedirectHosts),
+		pkce:           cfg.PKCE,
+		secureCookies:  cfg.SecureCookies,
+		userInfoMode:   userInfoMode,
+		claimMapping:   cfg.Claims.withDefaults(),
+		endSessionURL:  discovery.EndSessionEndpoint,
+		postLogoutURL:  postLogoutURL,
+		rpLogout:       cfg.RPLogout,
+		logoutBackend:  cfg.LogoutBackend,
+		logoutVerifier: logoutVerifier,
+		sessions:       cfg.Sessions,
+		sessionTTL:     cfg.SessionTTL,
+		proxySessions:  cfg.ProxySessions,
+		userLocks:      userLocks,
+
+		requireEmailVerified: cfg.RequireEmailVerified,
+		emailVerifiedExempt:  emailVerifiedExempt,
+
+		defaultFirstName: cfg.DefaultFirstName,
+		defaultLastName:  cfg.DefaultLastName,
 	}, nil
 }
 
-func (a *OIDCAuthenticator) StartAuth(w http.ResponseWriter, r *http.Request, redirectURL string) error {
-	state, err := a.createState(redirectURL)
+func (a *OIDCAuthenticator) Name() string {
+	return a.name
+}
+
+func (a *OIDCAuthenticator) DisplayName() string {
+	if a.displayName == "" {
+		return a.name
+	}
+	return a.displayName
+}
+
+func (a *OIDCAuthenticator) StartAuth(w http.ResponseWriter, r *http.Request, redirectURL string) (err error) {
+	_, span := tracing.Start(r.Context(), "oidc.StartAuth", attribute.String("oidc.provider", a.name))
+	defer func() { tracing.End(span, err) }()
+
+	state, st, err := a.createState(a.SanitizeRedirect(redirectURL))
 	if err != nil {
 		return err
 	}
+	a.bindState(w, state)
+
+	opts := []oauth2.AuthCodeOption{oidc.Nonce(st.Nonce)}
+	if a.pkce {
+		verifier := oauth2.GenerateVerifier()
+		a.setFlowCookie(w, flowCookieName(pkceCookiePrefix, state), verifier)
+		opts = append(opts, oauth2.S256ChallengeOption(verifier))
+	}
 
-	authURL := a.config.AuthCodeURL(state)
+	authURL := a.config.AuthCodeURL(state, opts...)
 	http.Redirect(w, r, authURL, http.StatusFound)
 	return nil
 }
 
-func (a *OIDCAuthenticator) HandleCallback(w http.ResponseWriter, r *http.Request) error {
-	ctx := r.Context()
+func (a *OIDCAuthenticator) HandleCallback(w http.ResponseWriter, r *http.Request) (err error) {
+	ctx, span := tracing.Start(r.Context(), "oidc.HandleCallback", attribute.String("oidc.provider", a.name))
+	defer func() { tracing.End(span, err) }()
+	metrics.LoginAttempt(a.name)
 
 	// Валидация state
 	state := r.URL.Query().Get("state")
-	redirectURL, err := a.validateState(state)
+	st, err := a.validateState(state)
 	if err != nil {
 		return fmt.Errorf("invalid state: %w", err)
 	}
+	// STATE_SECRET общий для всех провайдеров, поэтому state чужого провайдера подпись пройдёт
+	if st.Provider != a.name {
+		return fmt.Errorf("invalid state: issued for provider %q", st.Provider)
+	}
+	if !a.checkStateBinding(w, r, state) {
+		return fmt.Errorf("invalid state: not bound to this browser")
+	}
+	fresh, err := a.stateStore.Consume(ctx, stateHash(state), a.stateTTL)
+	if err != nil {
+		return fmt.Errorf("state store: %w", err)
+	}
+	if !fresh {
+		return fmt.Errorf("invalid state: already used")
+	}
+
+	// PKCE verifier
+	var exchangeOpts []oauth2.AuthCodeOption
+	if a.pkce {
+		cookieName := flowCookieName(pkceCookiePrefix, state)
+		verifier := readCookie(r, cookieName)
+		if verifier == "" {
+			return fmt.Errorf("missing PKCE code verifier")
+		}
+		a.clearFlowCookie(w, cookieName)
+		exchangeOpts = append(exchangeOpts, oauth2.VerifierOption(verifier))
+	}
 
 	// Обмен кода на токен
 	code := r.URL.Query().Get("code")
-	token, err := a.config.Exchange(ctx, code)
+	start := time.Now()
+	exchangeCtx, exchangeSpan := tracing.Start(ctx, "oidc.Exchange")
+	token, err := a.config.Exchange(exchangeCtx, code, exchangeOpts...)
+	tracing.End(exchangeSpan, err)
+	metrics.ObserveIdP(a.name, "exchange", start, err)
 	if err != nil {
 		return fmt.Errorf("token exchange failed: %w", err)
 	}
 
 	// Получение информации о пользователе
-	userData, err := a.extractUserInfo(ctx, token)
+	userData, claims, err := a.extractUserInfo(ctx, token, st.Nonce)
 	if err != nil {
 		return fmt.Errorf("failed to get user info: %w", err)
 	}
 
-	// Проверка домена email
-	if err := a.validateEmailDomain(userData.Email); err != nil {
-		return err
+	// Проверка ограничений доступа провайдера
+	if reason, err := a.checkAccess(ctx, userData, claims); err != nil {
+		return a.denied(reason, err)
 	}
 
-	// Проверка email'ов
-	if err := a.validateEmail(userData.Email); err != nil {
-		return err
+	// Provision и логин одного пользователя выполняются по очереди
+	unlock, err := a.userLocks.Lock(ctx, userData)
+	if err != nil {
+		return fmt.Errorf("user lock: %w", err)
 	}
+	defer unlock()
 
 	// Provision пользователя в бэкенде
-	userID, err := a.backend.ProvisionUser(ctx, userData)
+	start = time.Now()
+	provisionCtx, provisionSpan := tracing.Start(ctx, "backend.ProvisionUser")
+	userID, err := a.backend.ProvisionUser(provisionCtx, userData)
+	tracing.End(provisionSpan, err)
+	metrics.ObserveBackend("provision", start, err)
+	if errors.Is(err, backend.ErrProtectedAccount) {
+		return a.denied("protected_account", err)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to provision user: %w", err)
 	}
 
 	// Логин в бэкенде
-	cookies, err := a.backend.Login(ctx, userID, userData)
+	start = time.Now()
+	loginCtx, loginSpan := tracing.Start(ctx, "backend.Login")
+	cookies, err := a.backend.Login(loginCtx, userID, userData)
+	tracing.End(loginSpan, err)
+	metrics.ObserveBackend("login", start, err)
 	if err != nil {
 		return fmt.Errorf("failed to login: %w", err)
 	}
 
+	// Регистрация сессии для back-channel logout
+	if err := a.trackSession(r, claims, cookies); err != nil {
+		return fmt.Errorf("session registry: %w", err)
+	}
+
 	// Установка куков
 	a.cookieManager.SetSessionCookies(w, r, cookies)
+	if a.proxySessions != nil {
+		session := ProxySession{
+			Provider: a.name,
+			Issuer:   claimString(claims, []string{"iss"}),
+			Subject:  claimString(claims, []string{"sub"}),
+			SID:      claimString(claims, []string{"sid"}),
+			Email:    userData.Email,
+			User:     userData.Subject,
+			Groups:   userData.Groups,
+
+			BackendID: userID,
+			FirstName: userData.FirstName,
+			LastName:  userData.LastName,
+			Claims:    a.sessionClaims(claims),
+		}
+		err := a.proxySessions.Issue(w, session)
+		// Большие claim'ы не должны ломать вход: без них сессия не перепроверяет email_verified и политику
+		if errors.Is(err, ErrSessionTooLarge) && session.Claims != nil {
+			logging.FromContext(ctx).Warnf("claims of %s do not fit in the session cookie, email_verified and policy are checked only at login", userData.Email)
+			session.Claims = nil
+			session.ClaimsOmitted = true
+			err = a.proxySessions.Issue(w, session)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to issue proxy session: %w", err)
+		}
+	}
+	if rawIDToken, ok := token.Extra("id_token").(string); ok {
+		a.setSessionHint(w, r, rawIDToken)
+	}
 
 	// Редирект
-	http.Redirect(w, r, redirectURL, http.StatusFound)
+	metrics.LoginSuccess(a.name)
+	http.Redirect(w, r, a.SanitizeRedirect(st.Redirect), http.StatusFound)
 	return nil
 }
 
-func (a *OIDCAuthenticator) extractUserInfo(ctx context.Context, token *oauth2.Token) (backend.UserData, error) {
+// denied учитывает отказ во входе в метриках и возвращает err как есть.
+func (a *OIDCAuthenticator) denied(reason string, err error) error {
+	metrics.LoginDenied(a.name, reason)
+	return err
+}
+
+func (a *OIDCAuthenticator) extractUserInfo(ctx context.Context, token *oauth2.Token, nonce string) (backend.UserData, map[string]any, error) {
 	rawIDToken, ok := token.Extra("id_token").(string)
 	if !ok {
-		return backend.UserData{}, fmt.Errorf("no id_token in token response")
+		return backend.UserData{}, nil, fmt.Errorf("no id_token in token response")
 	}
 
-	idToken, err := a.verifier.Verify(ctx, rawIDToken)
+	start := time.Now()
+	verifyCtx, verifySpan := tracing.Start(ctx, "oidc.VerifyIDToken")
+	idToken, err := a.verifier.Verify(verifyCtx, rawIDToken)
+	tracing.End(verifySpan, err)
+	metrics.ObserveIdP(a.name, "verify", start, err)
 	if err != nil {
-		return backend.UserData{}, fmt.Errorf("failed to verify ID token: %w", err)
+		return backend.UserData{}, nil, fmt.Errorf("failed to verify ID token: %w", err)
 	}
 
-	var claims struct {
-		Sub               string `json:"sub"`
-		Email             string `json:"email"`
-		Name              string `json:"name"`
-		FamilyName        string `json:"family_name"`
-		GivenName         string `json:"given_name"`
-		PreferredUsername string `json:"preferred_username"`
+	// Nonce должен совпадать с выданным в StartAuth, иначе это чужой (переигранный) токен
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		return backend.UserData{}, nil, fmt.Errorf("ID token nonce mismatch")
 	}
 
+	claims := map[string]any{}
 	if err := idToken.Claims(&claims); err != nil {
-		return backend.UserData{}, fmt.Errorf("failed to parse claims: %w", err)
+		return backend.UserData{}, nil, fmt.Errorf("failed to parse claims: %w", err)
 	}
 
-	lastName, firstName := a.splitName(claims.Name)
+	// Дозапрос userinfo, если в ID токене не хватает email/имени (Azure AD, Authentik)
+	if a.userInfoMode == UserInfoAlways || (a.userInfoMode == UserInfoAuto && !a.claimMapping.complete(claims)) {
+		if err := a.mergeUserInfo(ctx, token, idToken.Subject, claims); err != nil {
+			if a.userInfoMode == UserInfoAlways {
+				return backend.UserData{}, nil, err
+			}
+			logging.FromContext(ctx).Warnf("userinfo fallback failed: %v", err)
+		}
+	}
+
+	firstName, lastName := a.splitName(claimString(claims, a.claimMapping.Name))
 
 	userData := backend.UserData{
-		Email:     claims.Email,
+		Email:     claimString(claims, a.claimMapping.Email),
 		FirstName: firstName,
 		LastName:  lastName,
-		Subject:   claims.Sub,
+		Subject:   claimString(claims, a.claimMapping.Subject),
+		Groups:    claimStrings(claims, a.claimMapping.Groups),
+	}
+	if userData.Email == "" {
+		return backend.UserData{}, nil, fmt.Errorf("no email claim in ID token or userinfo")
 	}
+	if userData.Subject == "" {
+		userData.Subject = idToken.Subject
+	}
+	userData.Issuer = idToken.Issuer
 
-	if claims.FamilyName != "" {
-		userData.LastName = claims.FamilyName
+	if lastName := claimString(claims, a.claimMapping.LastName); lastName != "" {
+		userData.LastName = lastName
 	}
 
-	if claims.GivenName != "" {
-		userData.FirstName = claims.GivenName
+	if firstName := claimString(claims, a.claimMapping.FirstName); firstName != "" {
+		userData.FirstName = firstName
 	}
 
-	return userData, nil
+	return userData, claims, nil
 }
 
+// splitName делит полное имя на имя и фамилию.
 func (a *OIDCAuthenticator) splitName(fullName string) (string, string) {
-	if fullName == "" {
-		return "User", "OIDC"
+	parts := strings.Fields(fullName)
+	if len(parts) == 0 {
+		return a.defaultFirstName, a.defaultLastName
 	}
 
-	parts := strings.Fields(fullName)
-	if len(parts) == 1 {
-		return parts[0], ""
+	// Первое слово — фамилия или имя в зависимости от OIDC_NAME_ORDER, остальное — вторая часть
+	head, rest := parts[0], strings.Join(parts[1:], " ")
+	if a.claimMapping.NameOrder == NameOrderFirstLast {
+		return head, rest
+	}
+	return rest, head
+}
+
+// Relogin заново входит в бэкенд от имени пользователя сессии прокси, когда сессия бэкенда
+// истекла. Личность уже проверена при выдаче сессии, поэтому к IdP не обращаемся.
+func (a *OIDCAuthenticator) Relogin(ctx context.Context, s *ProxySession) ([]string, error) {
+	if s.BackendID == "" {
+		return nil, fmt.Errorf("proxy session has no backend user")
+	}
+	// Сессия могла быть закрыта у провайдера уже после того, как её проверили
+	if a.sessions != nil {
+		revoked, err := a.sessions.Revoked(ctx, s.Issuer, s.Subject, s.SID, time.Unix(s.IssuedAt, 0))
+		if err != nil {
+			return nil, fmt.Errorf("session registry: %w", err)
+		}
+		if revoked {
+			return nil, errors.New("session revoked")
+		}
+	}
+	if err := a.Authorize(ctx, s); err != nil {
+		return nil, err
+	}
+	userData := s.userData()
+	unlock, err := a.userLocks.Lock(ctx, userData)
+	if err != nil {
+		return nil, fmt.Errorf("user lock: %w", err)
+	}
+	defer unlock()
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "backend.Login", attribute.Bool("relogin", true))
+	cookies, err := a.backend.Login(ctx, s.BackendID, userData)
+	tracing.End(span, err)
+	metrics.ObserveBackend("relogin", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to login: %w", err)
+	}
+	if a.sessions != nil {
+		err := a.sessions.Add(ctx, Session{
+			Issuer:    s.Issuer,
+			Subject:   s.Subject,
+			SID:       s.SID,
+			Cookies:   cookies,
+			ExpiresAt: time.Now().Add(a.sessionTTL),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("session registry: %w", err)
+		}
 	}
-	return parts[0], strings.Join(parts[1:], " ")
+	return cookies, nil
+}
+
+// Authorize повторно применяет к уже выданной сессии те же проверки, что и при логине,
+// чтобы изменения ALLOWED_*, REQUIRE_EMAIL_VERIFIED и ACCESS_POLICY действовали без повторного логина.
+func (a *OIDCAuthenticator) Authorize(ctx context.Context, s *ProxySession) error {
+	if s.ClaimsOmitted {
+		_, err := a.checkUser(s.userData())
+		return err
+	}
+	claims := s.Claims
+	if claims == nil {
+		claims = map[string]any{}
+	}
+	_, err := a.checkAccess(ctx, s.userData(), claims)
+	return err
+}
+
+// checkAccess применяет ограничения доступа провайдера. reason — причина отказа для метрик.
+func (a *OIDCAuthenticator) checkAccess(ctx context.Context, user backend.UserData, claims map[string]any) (string, error) {
+	if reason, err := a.checkUser(user); err != nil {
+		return reason, err
+	}
+
+	// Проверка подтверждённости email
+	if err := a.validateEmailVerified(user.Email, claims); err != nil {
+		return "email_verified", err
+	}
+
+	// Проверка политики доступа
+	if err := a.validatePolicy(ctx, user, claims); err != nil {
+		return "policy", err
+	}
+
+	return "", nil
+}
+
+// checkUser применяет ограничения, которым хватает данных самой сессии: ALLOWED_*.
+func (a *OIDCAuthenticator) checkUser(user backend.UserData) (string, error) {
+	// Проверка домена email
+	if err := a.validateEmailDomain(user.Email); err != nil {
+		return "domain", err
+	}
+
+	// Проверка email'ов
+	if err := a.validateEmail(user.Email); err != nil {
+		return "email", err
+	}
+
+	// Проверка групп
+	if err := a.validateGroups(user.Groups); err != nil {
+		return "group", err
+	}
+
+	return "", nil
+}
+
+// sessionClaims отбирает claim'ы, нужные checkAccess при проверке сессии прокси: email_verified
+// и те, что читает политика. Остальные (например, длинные списки групп) в куку не попадают.
+func (a *OIDCAuthenticator) sessionClaims(claims map[string]any) map[string]any {
+	out := map[string]any{}
+	if a.policy != nil {
+		a.policy.sessionClaims(claims, out)
+	}
+	if a.requireEmailVerified {
+		if v, ok := lookupClaim(claims, "email_verified"); ok {
+			out["email_verified"] = v
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
 }
 
 func (a *OIDCAuthenticator) validateEmailDomain(email string) error {
@@ -232,17 +611,84 @@ func (a *OIDCAuthenticator) validateEmail(email string) error {
 	return nil
 }
 
+func (a *OIDCAuthenticator) validateGroups(groups []string) error {
+	if len(a.allowedGroups) == 0 {
+		return nil
+	}
+
+	for _, group := range groups {
+		if _, allowed := a.allowedGroups[group]; allowed {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("user is not in an allowed group")
+}
+
+func (a *OIDCAuthenticator) validateEmailVerified(email string, claims map[string]any) error {
+	if !a.requireEmailVerified {
+		return nil
+	}
+
+	// Домены, чьи адреса IdP выдаёт сам (корпоративные), можно не проверять
+	if _, domain, ok := strings.Cut(email, "@"); ok {
+		if _, exempt := a.emailVerifiedExempt[strings.ToLower(domain)]; exempt {
+			return nil
+		}
+	}
+
+	verified, _ := lookupClaim(claims, "email_verified")
+	switch v := verified.(type) {
+	case bool:
+		if v {
+			return nil
+		}
+	case string:
+		// Некоторые IdP (например, Cognito) присылают булевы claim'ы строкой
+		if strings.EqualFold(v, "true") {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("email not verified")
+}
+
+func (a *OIDCAuthenticator) validatePolicy(ctx context.Context, user backend.UserData, claims map[string]any) error {
+	if a.policy == nil {
+		return nil
+	}
+
+	reason, err := a.policy.Evaluate(user, claims)
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		logging.FromContext(ctx).Warnf("access policy denied %s: %s", user.Email, reason)
+		return fmt.Errorf("access denied by policy")
+	}
+
+	return nil
+}
+
 // State management
-func (a *OIDCAuthenticator) createState(redirectURL string) (string, error) {
-	state := map[string]interface{}{
-		"redirect": redirectURL,
-		"ts":       time.Now().Unix(),
-		"nonce":    uuid.New().String(),
+type authState struct {
+	Redirect string `json:"redirect"`
+	Ts       int64  `json:"ts"`
+	Nonce    string `json:"nonce"`
+	Provider string `json:"provider"`
+}
+
+func (a *OIDCAuthenticator) createState(redirectURL string) (string, *authState, error) {
+	state := &authState{
+		Redirect: redirectURL,
+		Ts:       time.Now().Unix(),
+		Nonce:    uuid.New().String(),
+		Provider: a.name,
 	}
 
 	stateJSON, err := json.Marshal(state)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	mac := hmac.New(sha256.New, []byte(a.stateSecret))
@@ -250,23 +696,23 @@ func (a *OIDCAuthenticator) createState(redirectURL string) (string, error) {
 	signature := mac.Sum(nil)
 
 	return base64.RawURLEncoding.EncodeToString(stateJSON) + "." +
-		base64.RawURLEncoding.EncodeToString(signature), nil
+		base64.RawURLEncoding.EncodeToString(signature), state, nil
 }
 
-func (a *OIDCAuthenticator) validateState(rawState string) (string, error) {
+func (a *OIDCAuthenticator) validateState(rawState string) (*authState, error) {
 	parts := strings.Split(rawState, ".")
 	if len(parts) != 2 {
-		return "", fmt.Errorf("invalid state format")
+		return nil, fmt.Errorf("invalid state format")
 	}
 
 	stateJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
 	if err != nil {
-		return "", fmt.Errorf("invalid state encoding")
+		return nil, fmt.Errorf("invalid state encoding")
 	}
 
 	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
 	if err != nil {
-		return "", fmt.Errorf("invalid signature encoding")
+		return nil, fmt.Errorf("invalid signature encoding")
 	}
 
 	mac := hmac.New(sha256.New, []byte(a.stateSecret))
@@ -274,25 +720,26 @@ func (a *OIDCAuthenticator) validateState(rawState string) (string, error) {
 	expectedSignature := mac.Sum(nil)
 
 	if !hmac.Equal(signature, expectedSignature) {
-		return "", fmt.Errorf("invalid state signature")
+		return nil, fmt.Errorf("invalid state signature")
 	}
 
-	var state map[string]interface{}
+	var state authState
 	if err := json.Unmarshal(stateJSON, &state); err != nil {
-		return "", fmt.Errorf("invalid state JSON")
+		return nil, fmt.Errorf("invalid state JSON")
 	}
 
 	// Check expiration
-	if ts, ok := state["ts"].(float64); ok {
-		if time.Since(time.Unix(int64(ts), 0)) > a.stateTTL {
-			return "", fmt.Errorf("state expired")
-		}
+	if time.Since(time.Unix(state.Ts, 0)) > a.stateTTL {
+		return nil, fmt.Errorf("state expired")
+	}
+
+	if state.Nonce == "" {
+		return nil, fmt.Errorf("state without nonce")
 	}
 
-	redirect, ok := state["redirect"].(string)
-	if !ok || redirect == "" {
-		return "/", nil
+	if state.Redirect == "" {
+		state.Redirect = "/"
 	}
 
-	return redirect, nil
+	return &state, nil
 }
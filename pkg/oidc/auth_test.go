@@ -0,0 +1,430 @@
+package oidcauth
+
+import (
+	"any-oidc-proxy/pkg/backend"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeIdP — token endpoint провайдера: сверяет PKCE verifier с challenge и выдаёт ID токен с nonce.
+type fakeIdP struct {
+	t         *testing.T
+	signer    *testSigner
+	challenge string // code_challenge из URL авторизации; пустой — PKCE не проверяется
+	nonce     string // nonce, который попадёт в ID токен
+	verifier  string // code_verifier из последнего обмена кода
+	extra     map[string]any
+}
+
+func (p *fakeIdP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.verifier = r.PostForm.Get("code_verifier")
+	if p.challenge != "" {
+		sum := sha256.Sum256([]byte(p.verifier))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != p.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+	}
+	claims := map[string]any{
+		"iss":   testIssuer,
+		"aud":   testClientID,
+		"sub":   "user-1",
+		"email": "alice@example.com",
+		"name":  "Alice Liddell",
+		"nonce": p.nonce,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+	}
+	for k, v := range p.extra {
+		claims[k] = v
+	}
+	idToken := p.signer.sign(p.t, claims)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"access_token": "at", "token_type": "Bearer", "id_token": idToken})
+}
+
+func newFlowAuthenticator(t *testing.T, idp *fakeIdP, pkce bool) *OIDCAuthenticator {
+	t.Helper()
+	server := httptest.NewServer(idp)
+	t.Cleanup(server.Close)
+	return &OIDCAuthenticator{
+		name: "default",
+		config: &oauth2.Config{
+			ClientID:    testClientID,
+			RedirectURL: "https://proxy.example.com/oidc/callback",
+			Endpoint:    oauth2.Endpoint{AuthURL: testIssuer + "/auth", TokenURL: server.URL + "/token"},
+		},
+		verifier:      idp.signer.verifier(false),
+		backend:       &fakeBackend{},
+		cookieManager: backend.NewSimpleCookieManager(true),
+		stateSecret:   "secret",
+		stateTTL:      time.Minute,
+		stateStore:    NewMemoryStateStore(),
+		pkce:          pkce,
+		userInfoMode:  UserInfoNever,
+		claimMapping:  DefaultClaimMapping(),
+		userLocks:     NewUserLocks(),
+	}
+}
+
+// startLogin проходит StartAuth и возвращает параметры URL авторизации и куки, выставленные браузеру.
+func startLogin(t *testing.T, a *OIDCAuthenticator) (url.Values, []*http.Cookie) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	if err := a.StartAuth(w, httptest.NewRequest(http.MethodGet, "/oidc/login", nil), "/dashboard"); err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authURL.Query(), w.Result().Cookies()
+}
+
+// finishLogin возвращает браузер на callback с кодом и куками cookies.
+func finishLogin(a *OIDCAuthenticator, state string, cookies []*http.Cookie) (*httptest.ResponseRecorder, error) {
+	query := url.Values{"state": {state}, "code": {"code-1"}}
+	r := httptest.NewRequest(http.MethodGet, "/oidc/callback?"+query.Encode(), nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	return w, a.HandleCallback(w, r)
+}
+
+// withCookie заменяет значение куки с префиксом prefix; пустое значение убирает её.
+func withCookie(cookies []*http.Cookie, prefix, value string) []*http.Cookie {
+	var out []*http.Cookie
+	for _, c := range cookies {
+		if strings.HasPrefix(c.Name, prefix) {
+			if value == "" {
+				continue
+			}
+			c = &http.Cookie{Name: c.Name, Value: value}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func TestAuthorize(t *testing.T) {
+	policy, err := NewAccessPolicy(`claims.department == "data"`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		auth    *OIDCAuthenticator
+		session ProxySession
+		wantErr bool
+	}{
+		{
+			name:    "no restrictions",
+			auth:    &OIDCAuthenticator{},
+			session: ProxySession{Email: "alice@example.com"},
+		},
+		{
+			name:    "domain",
+			auth:    &OIDCAuthenticator{allowedDomains: map[string]struct{}{"example.com": {}}},
+			session: ProxySession{Email: "alice@other.org"},
+			wantErr: true,
+		},
+		{
+			name:    "group",
+			auth:    &OIDCAuthenticator{allowedGroups: map[string]struct{}{"staff": {}}},
+			session: ProxySession{Email: "alice@example.com", Groups: []string{"guests"}},
+			wantErr: true,
+		},
+		{
+			name:    "email verified",
+			auth:    &OIDCAuthenticator{requireEmailVerified: true},
+			session: ProxySession{Email: "alice@example.com", Claims: map[string]any{"email_verified": true}},
+		},
+		{
+			name:    "email not verified",
+			auth:    &OIDCAuthenticator{requireEmailVerified: true},
+			session: ProxySession{Email: "alice@example.com", Claims: map[string]any{"email_verified": false}},
+			wantErr: true,
+		},
+		{
+			name:    "claims omitted at login",
+			auth:    &OIDCAuthenticator{requireEmailVerified: true, policy: policy},
+			session: ProxySession{Email: "alice@example.com", ClaimsOmitted: true},
+		},
+		{
+			name:    "claims omitted still checks lists",
+			auth:    &OIDCAuthenticator{allowedDomains: map[string]struct{}{"example.com": {}}},
+			session: ProxySession{Email: "alice@other.org", ClaimsOmitted: true},
+			wantErr: true,
+		},
+		{
+			name:    "session without claims",
+			auth:    &OIDCAuthenticator{requireEmailVerified: true},
+			session: ProxySession{Email: "alice@example.com"},
+			wantErr: true,
+		},
+		{
+			name:    "policy allows",
+			auth:    &OIDCAuthenticator{policy: policy},
+			session: ProxySession{Email: "alice@example.com", Claims: map[string]any{"department": "data"}},
+		},
+		{
+			name:    "policy denies",
+			auth:    &OIDCAuthenticator{policy: policy},
+			session: ProxySession{Email: "alice@example.com", Claims: map[string]any{"department": "sales"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.auth.Authorize(context.Background(), &tt.session); (err != nil) != tt.wantErr {
+				t.Errorf("Authorize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSessionClaims(t *testing.T) {
+	claims := map[string]any{
+		"email_verified": true,
+		"department":     "data",
+		"realm_access":   map[string]any{"roles": []any{"admin"}},
+		"groups":         []any{"a", "b", "c"},
+	}
+	policy := func(expr string) *AccessPolicy {
+		p, err := NewAccessPolicy(expr, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	tests := []struct {
+		name string
+		auth *OIDCAuthenticator
+		want []string
+	}{
+		{name: "nothing to recheck", auth: &OIDCAuthenticator{}},
+		{name: "email verified only", auth: &OIDCAuthenticator{requireEmailVerified: true}, want: []string{"email_verified"}},
+		{name: "policy without claims", auth: &OIDCAuthenticator{policy: policy(`domain == "example.com"`)}},
+		{name: "selected claim", auth: &OIDCAuthenticator{policy: policy(`claims.department == "data"`)}, want: []string{"department"}},
+		{name: "indexed claim", auth: &OIDCAuthenticator{policy: policy(`claims["department"] == "data"`)}, want: []string{"department"}},
+		{name: "has macro", auth: &OIDCAuthenticator{policy: policy(`has(claims.department)`)}, want: []string{"department"}},
+		{name: "nested path", auth: &OIDCAuthenticator{policy: policy(`"admin" in claims.realm_access.roles`)}, want: []string{"realm_access"}},
+		{
+			name: "policy and email verified",
+			auth: &OIDCAuthenticator{policy: policy(`claims.department == "data"`), requireEmailVerified: true},
+			want: []string{"department", "email_verified"},
+		},
+		{
+			name: "iteration needs everything",
+			auth: &OIDCAuthenticator{policy: policy(`claims.exists(k, k == "department")`)},
+			want: []string{"department", "email_verified", "groups", "realm_access"},
+		},
+		{
+			name: "computed key needs everything",
+			auth: &OIDCAuthenticator{policy: policy(`claims[email] == true`)},
+			want: []string{"department", "email_verified", "groups", "realm_access"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.auth.sessionClaims(claims)
+			var keys []string
+			for k := range got {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			if strings.Join(keys, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("sessionClaims() keys = %v, want %v", keys, tt.want)
+			}
+		})
+	}
+}
+
+func TestPKCE(t *testing.T) {
+	tests := []struct {
+		name     string
+		pkce     bool
+		verifier string // подменяет verifier в куке; "-" убирает куку
+		wantErr  string
+	}{
+		{name: "verifier matches challenge", pkce: true},
+		{name: "disabled", pkce: false},
+		{name: "missing verifier cookie", pkce: true, verifier: "-", wantErr: "missing PKCE code verifier"},
+		{name: "other verifier", pkce: true, verifier: oauth2.GenerateVerifier(), wantErr: "token exchange failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := &fakeIdP{t: t, signer: newTestSigner(t)}
+			a := newFlowAuthenticator(t, idp, tt.pkce)
+			query, cookies := startLogin(t, a)
+			idp.nonce = query.Get("nonce")
+			idp.challenge = query.Get("code_challenge")
+
+			if tt.pkce && (idp.challenge == "" || query.Get("code_challenge_method") != "S256") {
+				t.Fatalf("auth URL has no S256 challenge: %v", query)
+			}
+			if !tt.pkce && idp.challenge != "" {
+				t.Fatalf("auth URL has a challenge with PKCE disabled: %v", query)
+			}
+			switch tt.verifier {
+			case "":
+			case "-":
+				cookies = withCookie(cookies, pkceCookiePrefix, "")
+			default:
+				cookies = withCookie(cookies, pkceCookiePrefix, tt.verifier)
+			}
+
+			w, err := finishLogin(a, query.Get("state"), cookies)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("HandleCallback() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("HandleCallback() error = %v", err)
+			}
+			if got := w.Header().Get("Location"); got != "/dashboard" {
+				t.Errorf("redirect = %q, want /dashboard", got)
+			}
+			if (idp.verifier != "") != tt.pkce {
+				t.Errorf("code_verifier sent = %q with PKCE %v", idp.verifier, tt.pkce)
+			}
+		})
+	}
+}
+
+func TestHandleCallbackNonce(t *testing.T) {
+	tests := []struct {
+		name    string
+		nonce   func(issued string) string
+		wantErr bool
+	}{
+		{name: "issued nonce", nonce: func(issued string) string { return issued }},
+		{name: "other nonce", nonce: func(string) string { return "replayed" }, wantErr: true},
+		{name: "no nonce", nonce: func(string) string { return "" }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := &fakeIdP{t: t, signer: newTestSigner(t)}
+			a := newFlowAuthenticator(t, idp, false)
+			query, cookies := startLogin(t, a)
+			if query.Get("nonce") == "" {
+				t.Fatalf("auth URL has no nonce: %v", query)
+			}
+			idp.nonce = tt.nonce(query.Get("nonce"))
+
+			_, err := finishLogin(a, query.Get("state"), cookies)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "nonce mismatch") {
+					t.Fatalf("HandleCallback() error = %v, want nonce mismatch", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("HandleCallback() error = %v", err)
+			}
+		})
+	}
+}
+
+// Claim'ы, не помещающиеся в куку сессии, не должны ломать вход.
+func TestHandleCallbackLargeClaims(t *testing.T) {
+	roles := make([]any, 300)
+	for i := range roles {
+		roles[i] = fmt.Sprintf("role-%03d", i)
+	}
+	tests := []struct {
+		name        string
+		expr        string
+		wantOmitted bool
+	}{
+		{name: "policy reads one claim", expr: `claims.department == "data"`},
+		{name: "policy reads all claims", expr: `claims.exists(k, k == "department")`, wantOmitted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := &fakeIdP{t: t, signer: newTestSigner(t), extra: map[string]any{"department": "data", "roles": roles}}
+			a := newFlowAuthenticator(t, idp, false)
+			policy, err := NewAccessPolicy(tt.expr, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a.policy = policy
+			if a.proxySessions, err = NewProxySessions("secret", "oidc_session", "", time.Hour, true, nil); err != nil {
+				t.Fatal(err)
+			}
+			query, cookies := startLogin(t, a)
+			idp.nonce = query.Get("nonce")
+
+			w, err := finishLogin(a, query.Get("state"), cookies)
+			if err != nil {
+				t.Fatalf("HandleCallback() error = %v", err)
+			}
+			var session *http.Cookie
+			for _, c := range w.Result().Cookies() {
+				if c.Name == "oidc_session" {
+					session = c
+				}
+			}
+			s, err := a.proxySessions.Verify(requestWithCookie(session))
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if s.ClaimsOmitted != tt.wantOmitted {
+				t.Errorf("ClaimsOmitted = %v, want %v (claims %v)", s.ClaimsOmitted, tt.wantOmitted, s.Claims)
+			}
+			if err := a.Authorize(context.Background(), s); err != nil {
+				t.Errorf("Authorize() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestSplitName(t *testing.T) {
+	tests := []struct {
+		name      string
+		order     string
+		fullName  string
+		wantFirst string
+		wantLast  string
+	}{
+		{name: "surname first by default", fullName: "Иванов Иван Петрович", wantFirst: "Иван Петрович", wantLast: "Иванов"},
+		{name: "single word is a surname", fullName: "Иванов", wantLast: "Иванов"},
+		{name: "given name first", order: NameOrderFirstLast, fullName: "Alice van Dijk", wantFirst: "Alice", wantLast: "van Dijk"},
+		{name: "single given name", order: NameOrderFirstLast, fullName: "Alice", wantFirst: "Alice"},
+		{name: "no name", fullName: "  ", wantFirst: "User", wantLast: "OIDC"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &OIDCAuthenticator{
+				claimMapping:     ClaimMapping{NameOrder: tt.order}.withDefaults(),
+				defaultFirstName: "User",
+				defaultLastName:  "OIDC",
+			}
+			first, last := a.splitName(tt.fullName)
+			if first != tt.wantFirst || last != tt.wantLast {
+				t.Errorf("splitName(%q) = %q, %q, want %q, %q", tt.fullName, first, last, tt.wantFirst, tt.wantLast)
+			}
+		})
+	}
+}
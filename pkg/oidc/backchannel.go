@@ -0,0 +1,146 @@
+package oidcauth
+
+import (
+	"any-oidc-proxy/pkg/backend"
+	"any-oidc-proxy/pkg/logging"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+	// logoutTokenMaxAge — насколько старый logout_token ещё принимается (по iat)
+	logoutTokenMaxAge = 5 * time.Minute
+	clockSkew         = time.Minute
+)
+
+// BackchannelLogout принимает logout_token от провайдера (OIDC Back-Channel Logout 1.0)
+// и закрывает все сессии бэкенда, выданные прокси для указанных sub/sid.
+func (a *OIDCAuthenticator) BackchannelLogout(w http.ResponseWriter, r *http.Request) error {
+	if a.sessions == nil {
+		return errors.New("back-channel logout is disabled")
+	}
+	if r.Method != http.MethodPost {
+		return fmt.Errorf("method %s not allowed", r.Method)
+	}
+	ctx := r.Context()
+
+	rawToken := r.PostFormValue("logout_token")
+	if rawToken == "" {
+		return errors.New("missing logout_token")
+	}
+
+	// Подпись, iss и aud проверяются по JWKS провайдера; exp в logout_token необязателен
+	token, err := a.logoutVerifier.Verify(ctx, rawToken)
+	if err != nil {
+		return fmt.Errorf("failed to verify logout token: %w", err)
+	}
+
+	var claims struct {
+		SID    string                     `json:"sid"`
+		JTI    string                     `json:"jti"`
+		Events map[string]json.RawMessage `json:"events"`
+	}
+	if err := token.Claims(&claims); err != nil {
+		return fmt.Errorf("failed to parse logout token: %w", err)
+	}
+
+	now := time.Now()
+	switch {
+	case token.Nonce != "":
+		return errors.New("logout token must not contain nonce")
+	case token.IssuedAt.IsZero() || now.Sub(token.IssuedAt) > logoutTokenMaxAge || token.IssuedAt.After(now.Add(clockSkew)):
+		return errors.New("logout token iat is missing or out of range")
+	case !token.Expiry.IsZero() && now.After(token.Expiry.Add(clockSkew)):
+		return errors.New("logout token expired")
+	case token.Subject == "" && claims.SID == "":
+		return errors.New("logout token has neither sub nor sid")
+	case claims.JTI == "":
+		return errors.New("logout token has no jti")
+	}
+	var event map[string]any
+	if raw, ok := claims.Events[backchannelLogoutEvent]; !ok || json.Unmarshal(raw, &event) != nil {
+		return errors.New("logout token has no back-channel logout event")
+	}
+
+	// Кука сессии прокси сама по себе действует до срока, поэтому отзыв запоминается отдельно
+	if err := a.sessions.Revoke(ctx, token.Issuer, token.Subject, claims.SID, now.Add(a.revocationTTL())); err != nil {
+		return fmt.Errorf("session registry: %w", err)
+	}
+
+	sessions, err := a.sessions.Take(ctx, token.Issuer, token.Subject, claims.SID)
+	if err != nil {
+		return fmt.Errorf("session registry: %w", err)
+	}
+
+	// Незакрытые сессии возвращаются в реестр, чтобы повтор logout_token от IdP смог их закрыть
+	var errs []error
+	failed := 0
+	if terminator, ok := a.backend.(backend.SessionTerminator); ok {
+		for _, s := range sessions {
+			if err := terminator.Logout(ctx, parseSetCookies(s.Cookies)); err != nil {
+				failed++
+				errs = append(errs, err)
+				if err := a.sessions.Add(ctx, s); err != nil {
+					errs = append(errs, fmt.Errorf("session registry: %w", err))
+				}
+			}
+		}
+	}
+	logging.FromContext(ctx).Infof("back-channel logout (%s): sub=%q sid=%q, closed %d of %d sessions",
+		a.name, token.Subject, claims.SID, len(sessions)-failed, len(sessions))
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to close backend sessions: %w", err)
+	}
+
+	// jti помечается использованным только после успеха, иначе повтор после сбоя был бы отвергнут
+	fresh, err := a.stateStore.Consume(ctx, "logout:"+claims.JTI, logoutTokenMaxAge+clockSkew)
+	if err != nil {
+		return fmt.Errorf("state store: %w", err)
+	}
+	if !fresh {
+		return errors.New("logout token already used")
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// trackSession регистрирует сессию бэкенда, выданную по ID токену с указанными claim'ами.
+func (a *OIDCAuthenticator) trackSession(r *http.Request, claims map[string]any, cookies []string) error {
+	if a.sessions == nil {
+		return nil
+	}
+	return a.sessions.Add(r.Context(), Session{
+		Issuer:    claimString(claims, []string{"iss"}),
+		Subject:   claimString(claims, []string{"sub"}),
+		SID:       claimString(claims, []string{"sid"}),
+		Cookies:   cookies,
+		ExpiresAt: time.Now().Add(a.sessionTTL),
+	})
+}
+
+// revocationTTL — сколько помнить отзыв: дольше, чем живёт любая выданная до него сессия.
+func (a *OIDCAuthenticator) revocationTTL() time.Duration {
+	ttl := a.sessionTTL
+	if a.proxySessions != nil && a.proxySessions.ttl > ttl {
+		ttl = a.proxySessions.ttl
+	}
+	return ttl
+}
+
+func parseSetCookies(raw []string) []*http.Cookie {
+	cookies := make([]*http.Cookie, 0, len(raw))
+	for _, line := range raw {
+		c, err := http.ParseSetCookie(line)
+		if err != nil {
+			continue
+		}
+		cookies = append(cookies, &http.Cookie{Name: c.Name, Value: c.Value})
+	}
+	return cookies
+}
@@ -0,0 +1,214 @@
+package oidcauth
+
+import (
+	"any-oidc-proxy/pkg/backend"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+const (
+	testIssuer   = "https://idp.example.com"
+	testClientID = "proxy"
+)
+
+// testSigner подписывает JWT ключом, которому доверяют верификаторы из newVerifier.
+type testSigner struct {
+	key *rsa.PrivateKey
+}
+
+func newTestSigner(t *testing.T) *testSigner {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{key: key}
+}
+
+func (s *testSigner) sign(t *testing.T, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (s *testSigner) verifier(skipExpiry bool) *oidc.IDTokenVerifier {
+	keys := &oidc.StaticKeySet{PublicKeys: []crypto.PublicKey{s.key.Public()}}
+	return oidc.NewVerifier(testIssuer, keys, &oidc.Config{ClientID: testClientID, SkipExpiryCheck: skipExpiry})
+}
+
+// fakeBackend запоминает закрытые сессии и может отказывать в их закрытии.
+type fakeBackend struct {
+	backend.NoopBackend
+	failLogout bool
+	closed     []string
+}
+
+func (f *fakeBackend) Logout(_ context.Context, cookies []*http.Cookie) error {
+	if f.failLogout {
+		return errors.New("backend unavailable")
+	}
+	for _, c := range cookies {
+		f.closed = append(f.closed, c.Value)
+	}
+	return nil
+}
+
+func logoutClaims(mutate func(map[string]any)) map[string]any {
+	claims := map[string]any{
+		"iss":    testIssuer,
+		"aud":    testClientID,
+		"sub":    "user-1",
+		"sid":    "sid-1",
+		"iat":    time.Now().Unix(),
+		"jti":    "jti-1",
+		"events": map[string]any{backchannelLogoutEvent: map[string]any{}},
+	}
+	if mutate != nil {
+		mutate(claims)
+	}
+	return claims
+}
+
+func postLogoutToken(a *OIDCAuthenticator, token string) (*httptest.ResponseRecorder, error) {
+	form := url.Values{"logout_token": {token}}
+	r := httptest.NewRequest(http.MethodPost, "/openid/backchannel-logout", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	return w, a.BackchannelLogout(w, r)
+}
+
+func newBackchannelAuthenticator(signer *testSigner, b *fakeBackend) *OIDCAuthenticator {
+	return &OIDCAuthenticator{
+		name:           "default",
+		backend:        b,
+		stateStore:     NewMemoryStateStore(),
+		logoutVerifier: signer.verifier(true),
+		sessions:       NewMemorySessionRegistry(),
+		sessionTTL:     time.Hour,
+	}
+}
+
+func addSession(t *testing.T, a *OIDCAuthenticator, sub, sid, cookie string) {
+	t.Helper()
+	err := a.sessions.Add(context.Background(), Session{
+		Issuer:    testIssuer,
+		Subject:   sub,
+		SID:       sid,
+		Cookies:   []string{"metabase.SESSION=" + cookie + "; Path=/"},
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackchannelLogoutValidation(t *testing.T) {
+	tests := []struct {
+		name       string
+		mutate     func(map[string]any)
+		wantErr    string
+		wantClosed []string
+	}{
+		{name: "valid", wantClosed: []string{"s1"}},
+		{name: "sub only", mutate: func(c map[string]any) { delete(c, "sid") }, wantClosed: []string{"s1", "s2"}},
+		{name: "sid only", mutate: func(c map[string]any) { delete(c, "sub") }, wantClosed: []string{"s1"}},
+		{name: "nonce", mutate: func(c map[string]any) { c["nonce"] = "n" }, wantErr: "nonce"},
+		{name: "no iat", mutate: func(c map[string]any) { delete(c, "iat") }, wantErr: "iat"},
+		{name: "stale iat", mutate: func(c map[string]any) { c["iat"] = time.Now().Add(-time.Hour).Unix() }, wantErr: "iat"},
+		{name: "future iat", mutate: func(c map[string]any) { c["iat"] = time.Now().Add(time.Hour).Unix() }, wantErr: "iat"},
+		{name: "expired", mutate: func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, wantErr: "expired"},
+		{name: "no sub and sid", mutate: func(c map[string]any) { delete(c, "sub"); delete(c, "sid") }, wantErr: "neither sub nor sid"},
+		{name: "no jti", mutate: func(c map[string]any) { delete(c, "jti") }, wantErr: "jti"},
+		{name: "no event", mutate: func(c map[string]any) { c["events"] = map[string]any{} }, wantErr: "event"},
+		{name: "other audience", mutate: func(c map[string]any) { c["aud"] = "someone-else" }, wantErr: "verify"},
+		{name: "other issuer", mutate: func(c map[string]any) { c["iss"] = "https://evil.test" }, wantErr: "verify"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer := newTestSigner(t)
+			b := &fakeBackend{}
+			a := newBackchannelAuthenticator(signer, b)
+			addSession(t, a, "user-1", "sid-1", "s1")
+			addSession(t, a, "user-1", "sid-2", "s2")
+			addSession(t, a, "user-2", "sid-3", "s3")
+
+			w, err := postLogoutToken(a, signer.sign(t, logoutClaims(tt.mutate)))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("BackchannelLogout() error = %v, want %q", err, tt.wantErr)
+				}
+				if len(b.closed) != 0 {
+					t.Errorf("closed %v on rejected token", b.closed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("BackchannelLogout() error = %v", err)
+			}
+			if w.Code != http.StatusOK {
+				t.Errorf("status = %d, want 200", w.Code)
+			}
+			if strings.Join(b.closed, ",") != strings.Join(tt.wantClosed, ",") {
+				t.Errorf("closed = %v, want %v", b.closed, tt.wantClosed)
+			}
+		})
+	}
+}
+
+func TestBackchannelLogoutReplay(t *testing.T) {
+	signer := newTestSigner(t)
+	a := newBackchannelAuthenticator(signer, &fakeBackend{})
+	token := signer.sign(t, logoutClaims(nil))
+
+	if _, err := postLogoutToken(a, token); err != nil {
+		t.Fatalf("first logout: %v", err)
+	}
+	if _, err := postLogoutToken(a, token); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Fatalf("replayed logout error = %v, want already used", err)
+	}
+}
+
+// Сбой бэкенда не должен терять сессии и сжигать jti: IdP повторит доставку.
+func TestBackchannelLogoutRetryAfterFailure(t *testing.T) {
+	signer := newTestSigner(t)
+	b := &fakeBackend{failLogout: true}
+	a := newBackchannelAuthenticator(signer, b)
+	addSession(t, a, "user-1", "sid-1", "s1")
+	token := signer.sign(t, logoutClaims(nil))
+
+	if _, err := postLogoutToken(a, token); err == nil {
+		t.Fatal("logout with failing backend succeeded")
+	}
+
+	b.failLogout = false
+	if _, err := postLogoutToken(a, token); err != nil {
+		t.Fatalf("retried logout: %v", err)
+	}
+	if strings.Join(b.closed, ",") != "s1" {
+		t.Errorf("closed = %v, want [s1]", b.closed)
+	}
+}
@@ -0,0 +1,144 @@
+package oidcauth
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ClaimMapping задаёт, из каких claim'ов заполняются поля backend.UserData.
+// Для каждого поля claim'ы перебираются по порядку до первого непустого значения;
+// путь может быть вложенным через точку (например, realm_access.roles).
+type ClaimMapping struct {
+	Subject   []string
+	Email     []string
+	FirstName []string
+	LastName  []string
+	Name      []string // полное имя, делится на имя и фамилию, если отдельных claim'ов нет
+	Groups    []string // группы собираются из всех перечисленных claim'ов
+	NameOrder string   // порядок слов в полном имени: last_first | first_last
+}
+
+const (
+	NameOrderLastFirst = "last_first" // "Фамилия Имя"
+	NameOrderFirstLast = "first_last" // "Имя Фамилия"
+)
+
+func DefaultClaimMapping() ClaimMapping {
+	return ClaimMapping{
+		Subject:   []string{"sub"},
+		Email:     []string{"email"},
+		FirstName: []string{"given_name"},
+		LastName:  []string{"family_name"},
+		Name:      []string{"name"},
+		Groups:    []string{"groups"},
+		NameOrder: NameOrderLastFirst,
+	}
+}
+
+func (m ClaimMapping) withDefaults() ClaimMapping {
+	def := DefaultClaimMapping()
+	if len(m.Subject) == 0 {
+		m.Subject = def.Subject
+	}
+	if len(m.Email) == 0 {
+		m.Email = def.Email
+	}
+	if len(m.FirstName) == 0 {
+		m.FirstName = def.FirstName
+	}
+	if len(m.LastName) == 0 {
+		m.LastName = def.LastName
+	}
+	if len(m.Name) == 0 {
+		m.Name = def.Name
+	}
+	if len(m.Groups) == 0 {
+		m.Groups = def.Groups
+	}
+	if m.NameOrder == "" {
+		m.NameOrder = def.NameOrder
+	}
+	return m
+}
+
+// complete сообщает, есть ли в claims всё нужное для провижининга без userinfo.
+func (m ClaimMapping) complete(claims map[string]any) bool {
+	return claimString(claims, m.Email) != "" &&
+		(claimString(claims, m.FirstName) != "" || claimString(claims, m.Name) != "")
+}
+
+// lookupClaim ищет claim по имени, а если его нет — по вложенному пути через точку.
+func lookupClaim(claims map[string]any, path string) (any, bool) {
+	if v, ok := claims[path]; ok {
+		return v, true
+	}
+	var cur any = claims
+	for _, part := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func claimString(claims map[string]any, paths []string) string {
+	for _, path := range paths {
+		v, ok := lookupClaim(claims, path)
+		if !ok {
+			continue
+		}
+		switch t := v.(type) {
+		case string:
+			if s := strings.TrimSpace(t); s != "" {
+				return s
+			}
+		case []any:
+			for _, item := range t {
+				if s, ok := item.(string); ok && strings.TrimSpace(s) != "" {
+					return strings.TrimSpace(s)
+				}
+			}
+		case float64, bool:
+			return fmt.Sprint(t)
+		}
+	}
+	return ""
+}
+
+// claimStrings объединяет значения всех перечисленных claim'ов (массивы или одиночные строки) без повторов.
+func claimStrings(claims map[string]any, paths []string) []string {
+	var out []string
+	seen := make(map[string]struct{})
+	add := func(s string) {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return
+		}
+		if _, ok := seen[s]; ok {
+			return
+		}
+		seen[s] = struct{}{}
+		out = append(out, s)
+	}
+	for _, path := range paths {
+		v, ok := lookupClaim(claims, path)
+		if !ok {
+			continue
+		}
+		switch t := v.(type) {
+		case string:
+			add(t)
+		case []any:
+			for _, item := range t {
+				if s, ok := item.(string); ok {
+					add(s)
+				}
+			}
+		}
+	}
+	return out
+}
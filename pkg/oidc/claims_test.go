@@ -0,0 +1,263 @@
+package oidcauth
+
+import (
+	"any-oidc-proxy/pkg/backend"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// testClaims — claims в том виде, в каком их разбирает encoding/json.
+var testClaims = map[string]any{
+	"email":              "alice@example.com",
+	"blank":              "  ",
+	"preferred_username": " alice ",
+	"emails":             []any{"", 42.0, "alice@corp.example.com"},
+	"groups":             []any{"dev", " ops ", "dev", 1.0},
+	"role":               "admin",
+	"employee_id":        1234.0,
+	"active":             true,
+	"realm_access":       map[string]any{"roles": []any{"offline_access", "admin"}},
+	"attrs":              map[string]any{"name": map[string]any{"given": "Alice"}},
+	"dotted.name":        "flat",
+	"nothing":            nil,
+}
+
+func TestLookupClaim(t *testing.T) {
+	tests := []struct {
+		path   string
+		want   any
+		wantOK bool
+	}{
+		{path: "email", want: "alice@example.com", wantOK: true},
+		{path: "attrs.name.given", want: "Alice", wantOK: true},
+		{path: "realm_access.roles", want: []any{"offline_access", "admin"}, wantOK: true},
+		{path: "dotted.name", want: "flat", wantOK: true},
+		{path: "nothing", want: nil, wantOK: true},
+		{path: "missing"},
+		{path: "attrs.missing"},
+		{path: "email.domain"},
+		{path: "realm_access.roles.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, ok := lookupClaim(testClaims, tt.path)
+			if ok != tt.wantOK || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lookupClaim(%q) = %v, %v; want %v, %v", tt.path, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestClaimString(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []string
+		want  string
+	}{
+		{name: "plain", paths: []string{"email"}, want: "alice@example.com"},
+		{name: "nested", paths: []string{"attrs.name.given"}, want: "Alice"},
+		{name: "trimmed", paths: []string{"preferred_username"}, want: "alice"},
+		{name: "first of fallbacks", paths: []string{"preferred_username", "email"}, want: "alice"},
+		{name: "missing falls back", paths: []string{"upn", "email"}, want: "alice@example.com"},
+		{name: "blank falls back", paths: []string{"blank", "email"}, want: "alice@example.com"},
+		{name: "null falls back", paths: []string{"nothing", "email"}, want: "alice@example.com"},
+		{name: "first string of array", paths: []string{"emails"}, want: "alice@corp.example.com"},
+		{name: "number", paths: []string{"employee_id"}, want: "1234"},
+		{name: "bool", paths: []string{"active"}, want: "true"},
+		{name: "object skipped", paths: []string{"attrs", "email"}, want: "alice@example.com"},
+		{name: "none", paths: []string{"upn", "blank"}, want: ""},
+		{name: "no paths", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := claimString(testClaims, tt.paths); got != tt.want {
+				t.Errorf("claimString(%v) = %q, want %q", tt.paths, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClaimStrings(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []string
+		want  []string
+	}{
+		{name: "array", paths: []string{"groups"}, want: []string{"dev", "ops"}},
+		{name: "single string", paths: []string{"role"}, want: []string{"admin"}},
+		{name: "nested", paths: []string{"realm_access.roles"}, want: []string{"offline_access", "admin"}},
+		{name: "merged without duplicates", paths: []string{"groups", "realm_access.roles", "role"}, want: []string{"dev", "ops", "offline_access", "admin"}},
+		{name: "missing skipped", paths: []string{"roles", "role"}, want: []string{"admin"}},
+		{name: "non-string values skipped", paths: []string{"employee_id", "active", "attrs", "nothing"}},
+		{name: "blank skipped", paths: []string{"blank"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := claimStrings(testClaims, tt.paths); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("claimStrings(%v) = %q, want %q", tt.paths, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClaimMappingComplete(t *testing.T) {
+	m := ClaimMapping{}.withDefaults()
+	tests := []struct {
+		name   string
+		claims map[string]any
+		want   bool
+	}{
+		{name: "email and given name", claims: map[string]any{"email": "a@example.com", "given_name": "Alice"}, want: true},
+		{name: "email and full name", claims: map[string]any{"email": "a@example.com", "name": "Alice Liddell"}, want: true},
+		{name: "no name", claims: map[string]any{"email": "a@example.com"}},
+		{name: "no email", claims: map[string]any{"name": "Alice Liddell"}},
+		{name: "blank email", claims: map[string]any{"email": " ", "name": "Alice Liddell"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.complete(tt.claims); got != tt.want {
+				t.Errorf("complete() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testNonce — nonce, с которым signedToken подписывает ID токен.
+const testNonce = "nonce-1"
+
+// signedToken — ответ token endpoint с ID токеном пользователя user-1, дополненным claims.
+func signedToken(t *testing.T, signer *testSigner, claims map[string]any) *oauth2.Token {
+	t.Helper()
+	all := map[string]any{
+		"iss":   testIssuer,
+		"aud":   testClientID,
+		"sub":   "user-1",
+		"nonce": testNonce,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+	token := &oauth2.Token{AccessToken: "at", TokenType: "Bearer"}
+	return token.WithExtra(map[string]any{"id_token": signer.sign(t, all)})
+}
+
+func TestExtractUserInfoMapping(t *testing.T) {
+	signer := newTestSigner(t)
+	claims := map[string]any{
+		"email":              "alice@example.com",
+		"upn":                "alice@corp.example.com",
+		"oid":                "object-1",
+		"name":               "Liddell Alice",
+		"attrs":              map[string]any{"first": "Alice", "last": "Liddell"},
+		"preferred_username": "",
+	}
+	tests := []struct {
+		name    string
+		mapping ClaimMapping
+		want    backend.UserData
+		wantErr bool
+	}{
+		{
+			name:    "defaults",
+			mapping: DefaultClaimMapping(),
+			want:    backend.UserData{Email: "alice@example.com", FirstName: "Alice", LastName: "Liddell", Subject: "user-1"},
+		},
+		{
+			name:    "fallback order",
+			mapping: ClaimMapping{Email: []string{"preferred_username", "upn", "email"}, Subject: []string{"oid"}}.withDefaults(),
+			want:    backend.UserData{Email: "alice@corp.example.com", FirstName: "Alice", LastName: "Liddell", Subject: "object-1"},
+		},
+		{
+			name:    "nested names",
+			mapping: ClaimMapping{FirstName: []string{"attrs.first"}, LastName: []string{"attrs.last"}, Name: []string{"missing"}}.withDefaults(),
+			want:    backend.UserData{Email: "alice@example.com", FirstName: "Alice", LastName: "Liddell", Subject: "user-1"},
+		},
+		{
+			name:    "first name first",
+			mapping: ClaimMapping{NameOrder: NameOrderFirstLast}.withDefaults(),
+			want:    backend.UserData{Email: "alice@example.com", FirstName: "Liddell", LastName: "Alice", Subject: "user-1"},
+		},
+		{
+			name:    "missing subject claim falls back to sub",
+			mapping: ClaimMapping{Subject: []string{"missing"}}.withDefaults(),
+			want:    backend.UserData{Email: "alice@example.com", FirstName: "Alice", LastName: "Liddell", Subject: "user-1"},
+		},
+		{
+			name:    "no email",
+			mapping: ClaimMapping{Email: []string{"mail"}}.withDefaults(),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &OIDCAuthenticator{verifier: signer.verifier(false), userInfoMode: UserInfoNever, claimMapping: tt.mapping}
+			got, _, err := a.extractUserInfo(context.Background(), signedToken(t, signer, claims), testNonce)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractUserInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			tt.want.Issuer = testIssuer
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extractUserInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowedGroupsClaim(t *testing.T) {
+	signer := newTestSigner(t)
+	claims := map[string]any{
+		"email":        "alice@example.com",
+		"name":         "Liddell Alice",
+		"groups":       []any{"staff"},
+		"realm_access": map[string]any{"roles": []any{"offline_access", "proxy-users"}},
+		"role":         "analyst",
+	}
+	tests := []struct {
+		name    string
+		groups  []string // claim'ы групп; пустой — по умолчанию groups
+		allowed []string
+		wantErr bool
+	}{
+		{name: "default claim", allowed: []string{"staff"}},
+		{name: "nested claim", groups: []string{"realm_access.roles"}, allowed: []string{"proxy-users"}},
+		{name: "single string claim", groups: []string{"role"}, allowed: []string{"analyst"}},
+		{name: "any of several claims", groups: []string{"realm_access.roles", "role"}, allowed: []string{"analyst"}},
+		{name: "default claim not read", groups: []string{"realm_access.roles"}, allowed: []string{"staff"}, wantErr: true},
+		{name: "missing claim", groups: []string{"resource_access.proxy.roles"}, allowed: []string{"proxy-users"}, wantErr: true},
+		{name: "no restriction", groups: []string{"resource_access.proxy.roles"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed := make(map[string]struct{})
+			for _, g := range tt.allowed {
+				allowed[g] = struct{}{}
+			}
+			a := &OIDCAuthenticator{
+				verifier:      signer.verifier(false),
+				userInfoMode:  UserInfoNever,
+				claimMapping:  ClaimMapping{Groups: tt.groups}.withDefaults(),
+				allowedGroups: allowed,
+			}
+			user, _, err := a.extractUserInfo(context.Background(), signedToken(t, signer, claims), testNonce)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reason, err := a.checkUser(user)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkUser(%v) error = %v, wantErr %v", user.Groups, err, tt.wantErr)
+			}
+			if err != nil && reason != "group" {
+				t.Errorf("checkUser() reason = %q, want group", reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package oidcauth
+
+import (
+	"any-oidc-proxy/pkg/logging"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+)
+
+const (
+	pkceCookiePrefix  = "oidc_pkce_"
+	stateCookiePrefix = "oidc_state_"
+	idTokenCookieName = "oidc_id_token"
+	// ProviderCookieName хранит имя провайдера, через которого вошёл пользователь
+	ProviderCookieName = "oidc_provider"
+	// maxCookieSize — сколько браузеры гарантированно хранят в одной куке (имя и значение)
+	maxCookieSize = 4096
+)
+
+// flowCookieName привязывает имя временной куки к конкретному state,
+// чтобы параллельные логины в нескольких вкладках не перетирали друг друга.
+func flowCookieName(prefix, state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return prefix + hex.EncodeToString(sum[:4])
+}
+
+func stateHash(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// bindState закрепляет state за браузером, который начал логин.
+func (a *OIDCAuthenticator) bindState(w http.ResponseWriter, state string) {
+	a.setFlowCookie(w, flowCookieName(stateCookiePrefix, state), stateHash(state))
+}
+
+// checkStateBinding сверяет state из callback с кукой, выставленной в StartAuth, и удаляет куку.
+func (a *OIDCAuthenticator) checkStateBinding(w http.ResponseWriter, r *http.Request, state string) bool {
+	name := flowCookieName(stateCookiePrefix, state)
+	bound := readCookie(r, name)
+	if bound == "" {
+		return false
+	}
+	a.clearFlowCookie(w, name)
+	return subtle.ConstantTimeCompare([]byte(bound), []byte(stateHash(state))) == 1
+}
+
+// setSessionHint запоминает ID токен и провайдера для RP-initiated logout (id_token_hint).
+// Слишком большой токен браузер молча отбросит, поэтому выход обойдётся без id_token_hint.
+func (a *OIDCAuthenticator) setSessionHint(w http.ResponseWriter, r *http.Request, rawIDToken string) {
+	hints := map[string]string{ProviderCookieName: a.name}
+	if len(idTokenCookieName)+1+len(rawIDToken) <= maxCookieSize {
+		hints[idTokenCookieName] = rawIDToken
+	} else {
+		logging.FromContext(r.Context()).Warnf("ID token of %d bytes does not fit in a cookie, logout will go without id_token_hint", len(rawIDToken))
+	}
+	for name, value := range hints {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    value,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   a.secureCookies,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+}
+
+func (a *OIDCAuthenticator) clearSessionHint(w http.ResponseWriter) {
+	a.clearFlowCookie(w, idTokenCookieName)
+	a.clearFlowCookie(w, ProviderCookieName)
+}
+
+func (a *OIDCAuthenticator) setFlowCookie(w http.ResponseWriter, name, value string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(a.stateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   a.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (a *OIDCAuthenticator) clearFlowCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   a.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func readCookie(r *http.Request, name string) string {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
@@ -0,0 +1,59 @@
+package oidcauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckStateBinding(t *testing.T) {
+	const state, other = "state-1", "state-2"
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		want   bool
+	}{
+		{name: "same browser", cookie: &http.Cookie{Name: flowCookieName(stateCookiePrefix, state), Value: stateHash(state)}, want: true},
+		{name: "no cookie"},
+		{name: "cookie of another login", cookie: &http.Cookie{Name: flowCookieName(stateCookiePrefix, other), Value: stateHash(other)}},
+		{name: "other state in cookie", cookie: &http.Cookie{Name: flowCookieName(stateCookiePrefix, state), Value: stateHash(other)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &OIDCAuthenticator{}
+			r := httptest.NewRequest(http.MethodGet, "/oidc/callback", nil)
+			if tt.cookie != nil {
+				r.AddCookie(tt.cookie)
+			}
+			w := httptest.NewRecorder()
+			if got := a.checkStateBinding(w, r, state); got != tt.want {
+				t.Fatalf("checkStateBinding() = %v, want %v", got, tt.want)
+			}
+			// привязка одноразовая: найденная кука удаляется
+			if tt.cookie != nil && tt.cookie.Name == flowCookieName(stateCookiePrefix, state) {
+				cleared := w.Result().Cookies()
+				if len(cleared) != 1 || cleared[0].MaxAge >= 0 {
+					t.Errorf("state cookie not cleared: %v", cleared)
+				}
+			}
+		})
+	}
+}
+
+// Ссылка на callback с чужим state (login CSRF) не должна логинить браузер жертвы.
+func TestHandleCallbackForeignState(t *testing.T) {
+	idp := &fakeIdP{t: t, signer: newTestSigner(t)}
+	a := newFlowAuthenticator(t, idp, false)
+	query, cookies := startLogin(t, a)
+	idp.nonce = query.Get("nonce")
+
+	victim := withCookie(cookies, stateCookiePrefix, "")
+	if _, err := finishLogin(a, query.Get("state"), victim); err == nil || !strings.Contains(err.Error(), "not bound") {
+		t.Fatalf("HandleCallback() without state cookie error = %v, want not bound", err)
+	}
+	// state не сгорел: браузер, начавший логин, по-прежнему может его завершить
+	if _, err := finishLogin(a, query.Get("state"), cookies); err != nil {
+		t.Fatalf("HandleCallback() in the original browser: %v", err)
+	}
+}
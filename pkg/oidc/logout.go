@@ -0,0 +1,94 @@
+package oidcauth
+
+import (
+	"any-oidc-proxy/pkg/backend"
+	"any-oidc-proxy/pkg/logging"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ErrCrossSiteLogout — запрос на выход пришёл не со страниц прокси или разрешённых хостов.
+var ErrCrossSiteLogout = errors.New("cross-site logout request")
+
+// Logout завершает сессию пользователя: удаляет куки бэкенда, при необходимости закрывает
+// сессию бэкенда на сервере и отправляет браузер на end_session_endpoint провайдера.
+func (a *OIDCAuthenticator) Logout(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	// Иначе любая страница в интернете могла бы разлогинить пользователя картинкой или ссылкой
+	if !a.sameSiteRequest(r) {
+		return ErrCrossSiteLogout
+	}
+
+	if a.logoutBackend {
+		if terminator, ok := a.backend.(backend.SessionTerminator); ok {
+			if err := terminator.Logout(ctx, r.Cookies()); err != nil {
+				logging.FromContext(ctx).Warnf("backend logout failed: %v", err)
+			}
+		}
+	}
+	a.cookieManager.ClearSessionCookies(w, r)
+	if a.proxySessions != nil {
+		a.revokeProxySession(r)
+		a.proxySessions.Clear(w)
+	}
+
+	idToken := readCookie(r, idTokenCookieName)
+	a.clearSessionHint(w)
+
+	if !a.rpLogout || a.endSessionURL == "" {
+		http.Redirect(w, r, a.postLogoutURL, http.StatusFound)
+		return nil
+	}
+
+	u, err := url.Parse(a.endSessionURL)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	if idToken != "" {
+		q.Set("id_token_hint", idToken)
+	}
+	q.Set("client_id", a.config.ClientID)
+	q.Set("post_logout_redirect_uri", a.postLogoutURL)
+	u.RawQuery = q.Encode()
+
+	http.Redirect(w, r, u.String(), http.StatusFound)
+	return nil
+}
+
+// revokeProxySession отзывает сессию прокси вместе с сессией IdP, чтобы скопированная кука
+// не пережила выход. Без sid отзыв задел бы все устройства пользователя, поэтому он пропускается.
+func (a *OIDCAuthenticator) revokeProxySession(r *http.Request) {
+	if a.sessions == nil {
+		return
+	}
+	s, err := a.proxySessions.Verify(r)
+	if err != nil || s.SID == "" {
+		return
+	}
+	ctx := r.Context()
+	if err := a.sessions.Revoke(ctx, s.Issuer, s.Subject, s.SID, time.Now().Add(a.revocationTTL())); err != nil {
+		logging.FromContext(ctx).Warnf("failed to revoke proxy session: %v", err)
+	}
+}
+
+// sameSiteRequest проверяет, что запрос отправлен со страниц EXTERNAL_URL или ALLOWED_REDIRECT_HOSTS.
+func (a *OIDCAuthenticator) sameSiteRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		return false
+	}
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	}
+	for _, header := range []string{"Origin", "Referer"} {
+		if v := r.Header.Get(header); v != "" {
+			u, err := url.Parse(v)
+			return err == nil && a.redirectHostAllowed(u)
+		}
+	}
+	// Источник неизвестен. POST без Origin браузер не отправит, а GET может быть картинкой с чужой страницы
+	return r.Method == http.MethodPost && r.Header.Get("Sec-Fetch-Site") == ""
+}
@@ -0,0 +1,40 @@
+package oidcauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSameSiteRequest(t *testing.T) {
+	a := &OIDCAuthenticator{redirectHosts: newRedirectHosts("https://app.example.com", []string{"*.example.com"})}
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    bool
+	}{
+		{name: "same origin", method: http.MethodGet, headers: map[string]string{"Sec-Fetch-Site": "same-origin"}, want: true},
+		{name: "typed url", method: http.MethodGet, headers: map[string]string{"Sec-Fetch-Site": "none"}, want: true},
+		{name: "cross site", method: http.MethodGet, headers: map[string]string{"Sec-Fetch-Site": "cross-site", "Referer": "https://evil.test/"}},
+		{name: "cross site without referer", method: http.MethodGet, headers: map[string]string{"Sec-Fetch-Site": "cross-site"}},
+		{name: "allowed subdomain", method: http.MethodGet, headers: map[string]string{"Sec-Fetch-Site": "same-site", "Referer": "https://bi.example.com/x"}, want: true},
+		{name: "origin match", method: http.MethodPost, headers: map[string]string{"Origin": "https://app.example.com"}, want: true},
+		{name: "origin mismatch", method: http.MethodPost, headers: map[string]string{"Origin": "https://evil.test"}},
+		{name: "null origin", method: http.MethodPost, headers: map[string]string{"Origin": "null"}},
+		{name: "bare get", method: http.MethodGet},
+		{name: "bare post", method: http.MethodPost, want: true},
+		{name: "other method", method: http.MethodDelete, headers: map[string]string{"Sec-Fetch-Site": "same-origin"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "https://app.example.com/openid/logout", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := a.sameSiteRequest(r); got != tt.want {
+				t.Errorf("sameSiteRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package oidcauth
+
+import (
+	"any-oidc-proxy/pkg/backend"
+	"fmt"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	celast "github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+)
+
+// AccessPolicy — CEL-выражение над проверенными claim'ами, решающее, пускать ли пользователя.
+//
+// Доступные переменные: claims (все claim'ы ID токена и userinfo), email, domain, subject,
+// groups и lists (именованные списки из конфигурации). Выражение возвращает bool либо строку:
+// пустая строка разрешает вход, непустая запрещает и используется как причина отказа.
+// email, domain, groups и значения lists приводятся к нижнему регистру, чтобы их можно было сравнивать
+// друг с другом; claims передаются как есть.
+//
+//	domain == "example.com" && ("data-team" in groups || email in lists.contractors)
+type AccessPolicy struct {
+	expr    string
+	program cel.Program
+	lists   map[string][]string
+	// claims — claim'ы верхнего уровня, к которым обращается выражение; allClaims — выражение
+	// работает с claims целиком (перебор, вычисляемый ключ), и нужны все
+	claims    []string
+	allClaims bool
+}
+
+func NewAccessPolicy(expr string, lists map[string][]string) (*AccessPolicy, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("claims", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("email", cel.StringType),
+		cel.Variable("domain", cel.StringType),
+		cel.Variable("subject", cel.StringType),
+		cel.Variable("groups", cel.ListType(cel.StringType)),
+		cel.Variable("lists", cel.MapType(cel.StringType, cel.ListType(cel.StringType))),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ast, issues := env.Compile(expr)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("invalid access policy: %w", issues.Err())
+	}
+	if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.StringType && ast.OutputType() != cel.DynType {
+		return nil, fmt.Errorf("invalid access policy: must return bool or string, got %s", ast.OutputType())
+	}
+
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access policy: %w", err)
+	}
+
+	normalized := make(map[string][]string, len(lists))
+	for name, values := range lists {
+		normalized[name] = normalizeValues(values)
+	}
+	p := &AccessPolicy{expr: expr, program: program, lists: normalized}
+	p.collectClaims(ast.NativeRep().Expr())
+	return p, nil
+}
+
+// collectClaims находит claim'ы, которые читает выражение: claims.name, claims["name"] и их
+// optional-варианты. Любое другое обращение к claims требует сохранять их все.
+func (p *AccessPolicy) collectClaims(e celast.Expr) {
+	switch e.Kind() {
+	case celast.IdentKind:
+		if e.AsIdent() == "claims" {
+			p.allClaims = true
+		}
+	case celast.SelectKind:
+		sel := e.AsSelect()
+		if isClaimsIdent(sel.Operand()) {
+			p.claims = append(p.claims, sel.FieldName())
+			return
+		}
+		p.collectClaims(sel.Operand())
+	case celast.CallKind:
+		call := e.AsCall()
+		switch call.FunctionName() {
+		case operators.Index, operators.OptIndex, operators.OptSelect:
+			args := call.Args()
+			if isClaimsIdent(args[0]) && args[1].Kind() == celast.LiteralKind {
+				if key, ok := args[1].AsLiteral().Value().(string); ok {
+					p.claims = append(p.claims, key)
+					return
+				}
+			}
+		}
+		if call.IsMemberFunction() {
+			p.collectClaims(call.Target())
+		}
+		for _, arg := range call.Args() {
+			p.collectClaims(arg)
+		}
+	case celast.ListKind:
+		for _, el := range e.AsList().Elements() {
+			p.collectClaims(el)
+		}
+	case celast.MapKind:
+		for _, entry := range e.AsMap().Entries() {
+			p.collectClaims(entry.AsMapEntry().Key())
+			p.collectClaims(entry.AsMapEntry().Value())
+		}
+	case celast.StructKind:
+		for _, field := range e.AsStruct().Fields() {
+			p.collectClaims(field.AsStructField().Value())
+		}
+	case celast.ComprehensionKind:
+		c := e.AsComprehension()
+		for _, part := range []celast.Expr{c.IterRange(), c.AccuInit(), c.LoopCondition(), c.LoopStep(), c.Result()} {
+			p.collectClaims(part)
+		}
+	}
+}
+
+func isClaimsIdent(e celast.Expr) bool {
+	return e.Kind() == celast.IdentKind && e.AsIdent() == "claims"
+}
+
+// sessionClaims отбирает из claims те, что нужны выражению при повторной проверке сессии.
+func (p *AccessPolicy) sessionClaims(claims map[string]any, out map[string]any) {
+	if p.allClaims {
+		for k, v := range claims {
+			out[k] = v
+		}
+		return
+	}
+	for _, k := range p.claims {
+		if v, ok := claims[k]; ok {
+			out[k] = v
+		}
+	}
+}
+
+// normalizeValues приводит значения к нижнему регистру без пробелов по краям и отбрасывает пустые.
+func normalizeValues(values []string) []string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Evaluate возвращает пустую строку, если доступ разрешён, иначе — причину отказа.
+func (p *AccessPolicy) Evaluate(user backend.UserData, claims map[string]any) (string, error) {
+	email := strings.ToLower(user.Email)
+	_, domain, _ := strings.Cut(email, "@")
+	// Группы сравниваются со списками, поэтому нормализуются так же, как они
+	groups := normalizeValues(user.Groups)
+
+	out, _, err := p.program.Eval(map[string]any{
+		"claims":  claims,
+		"email":   email,
+		"domain":  domain,
+		"subject": user.Subject,
+		"groups":  groups,
+		"lists":   p.lists,
+	})
+	if err != nil {
+		return "", fmt.Errorf("access policy evaluation failed: %w", err)
+	}
+
+	switch v := out.(type) {
+	case types.Bool:
+		if v {
+			return "", nil
+		}
+		return fmt.Sprintf("policy %q evaluated to false", p.expr), nil
+	case types.String:
+		return string(v), nil
+	default:
+		return "", fmt.Errorf("access policy returned %s, expected bool or string", out.Type())
+	}
+}
@@ -0,0 +1,93 @@
+package oidcauth
+
+import (
+	"any-oidc-proxy/pkg/backend"
+	"testing"
+)
+
+func TestAccessPolicyEvaluate(t *testing.T) {
+	lists := map[string][]string{
+		"contractors": {" Alice@Example.COM", "bob@example.com "},
+		"admins":      {"Data-Team", "platform"},
+	}
+	tests := []struct {
+		name      string
+		expr      string
+		user      backend.UserData
+		wantAllow bool
+	}{
+		{
+			name:      "domain match",
+			expr:      `domain == "example.com"`,
+			user:      backend.UserData{Email: "Carol@Example.com"},
+			wantAllow: true,
+		},
+		{
+			name:      "list match ignores case and spaces",
+			expr:      `email in lists.contractors`,
+			user:      backend.UserData{Email: "alice@example.com"},
+			wantAllow: true,
+		},
+		{
+			name: "not in list",
+			expr: `email in lists.contractors`,
+			user: backend.UserData{Email: "mallory@example.com"},
+		},
+		{
+			name:      "group match",
+			expr:      `"data-team" in groups`,
+			user:      backend.UserData{Email: "a@example.com", Groups: []string{"data-team"}},
+			wantAllow: true,
+		},
+		{
+			name:      "mixed-case group in list",
+			expr:      `groups.exists(g, g in lists.admins)`,
+			user:      backend.UserData{Email: "a@example.com", Groups: []string{"Data-Team"}},
+			wantAllow: true,
+		},
+		{
+			name:      "mixed-case group literal",
+			expr:      `"data-team" in groups`,
+			user:      backend.UserData{Email: "a@example.com", Groups: []string{" DATA-team"}},
+			wantAllow: true,
+		},
+		{
+			name: "group not in list",
+			expr: `groups.exists(g, g in lists.admins)`,
+			user: backend.UserData{Email: "a@example.com", Groups: []string{"data-team-readonly"}},
+		},
+		{
+			name: "no groups",
+			expr: `groups.exists(g, g in lists.admins)`,
+			user: backend.UserData{Email: "a@example.com"},
+		},
+		{
+			name: "string reason denies",
+			expr: `email.endsWith("@example.com") ? "" : "outsider"`,
+			user: backend.UserData{Email: "a@other.org"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := NewAccessPolicy(tt.expr, lists)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reason, err := policy.Evaluate(tt.user, map[string]any{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allow := reason == ""; allow != tt.wantAllow {
+				t.Errorf("Evaluate() reason = %q, want allow %v", reason, tt.wantAllow)
+			}
+		})
+	}
+}
+
+func TestNewAccessPolicyRejectsInvalid(t *testing.T) {
+	for _, expr := range []string{`email ==`, `1 + 2`} {
+		if _, err := NewAccessPolicy(expr, nil); err == nil {
+			t.Errorf("NewAccessPolicy(%q) succeeded, want error", expr)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package oidcauth
+
+import (
+	"any-oidc-proxy/pkg/backend"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ProxySession — содержимое сессионной куки прокси.
+type ProxySession struct {
+	Provider  string   `json:"p"`
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	SID       string   `json:"sid,omitempty"`
+	Email     string   `json:"email"`
+	User      string   `json:"user"`
+	Groups    []string `json:"groups,omitempty"`
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+	// Данные для повторного входа в бэкенд без похода к IdP
+	BackendID string `json:"bid,omitempty"`
+	FirstName string `json:"fn,omitempty"`
+	LastName  string `json:"ln,omitempty"`
+	// Claims — claim'ы, по которым Authorize повторяет проверки email_verified и ACCESS_POLICY;
+	// ClaimsOmitted — они не поместились в куку, и эти проверки выполнены только при логине
+	Claims        map[string]any `json:"claims,omitempty"`
+	ClaimsOmitted bool           `json:"nc,omitempty"`
+}
+
+// ErrSessionTooLarge — сессия не помещается в куку.
+var ErrSessionTooLarge = errors.New("session cookie too large")
+
+func (s *ProxySession) userData() backend.UserData {
+	return backend.UserData{
+		Email:     s.Email,
+		FirstName: s.FirstName,
+		LastName:  s.LastName,
+		Subject:   s.User,
+		Issuer:    s.Issuer,
+		Groups:    s.Groups,
+	}
+}
+
+// ProxySessions выдаёт и проверяет собственную сессию прокси: зашифрованную AES-GCM куку
+// с ограниченным сроком жизни. Пока она действительна и не отозвана back-channel logout'ом,
+// запросы пропускаются к бэкенду.
+type ProxySessions struct {
+	aead        cipher.AEAD
+	cookieName  string
+	domain      string
+	ttl         time.Duration
+	secure      bool
+	revocations RevocationList
+}
+
+// NewProxySessions создаёт выпуск сессий. domain — домен куки, чтобы сессию видели соседние
+// поддомены (forward auth); пустой — кука только для текущего хоста. revocations — список
+// закрытых у провайдера сессий; nil — кука действует до истечения срока.
+func NewProxySessions(secret, cookieName, domain string, ttl time.Duration, secure bool, revocations RevocationList) (*ProxySessions, error) {
+	if secret == "" {
+		return nil, errors.New("empty session secret")
+	}
+	key := sha256.Sum256([]byte("proxy-session:" + secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &ProxySessions{
+		aead:        aead,
+		cookieName:  cookieName,
+		domain:      domain,
+		ttl:         ttl,
+		secure:      secure,
+		revocations: revocations,
+	}, nil
+}
+
+// Issue выставляет куку сессии сроком на ttl.
+func (p *ProxySessions) Issue(w http.ResponseWriter, s ProxySession) error {
+	now := time.Now()
+	s.IssuedAt = now.Unix()
+	s.ExpiresAt = now.Add(p.ttl).Unix()
+	plain, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := p.aead.Seal(nonce, nonce, plain, []byte(p.cookieName))
+	value := base64.RawURLEncoding.EncodeToString(sealed)
+	// Браузер молча отбросит большую куку, и пользователь застрянет в цикле логина
+	if len(p.cookieName)+1+len(value) > maxCookieSize {
+		return fmt.Errorf("%w: %d bytes exceeds %d", ErrSessionTooLarge, len(value), maxCookieSize)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     p.cookieName,
+		Value:    value,
+		Path:     "/",
+		Domain:   p.domain,
+		MaxAge:   int(p.ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   p.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// Verify расшифровывает куку сессии и проверяет срок её действия и отзыв.
+func (p *ProxySessions) Verify(r *http.Request) (*ProxySession, error) {
+	raw := readCookie(r, p.cookieName)
+	if raw == "" {
+		return nil, errors.New("no session cookie")
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil || len(sealed) < p.aead.NonceSize() {
+		return nil, errors.New("malformed session cookie")
+	}
+	nonce, ciphertext := sealed[:p.aead.NonceSize()], sealed[p.aead.NonceSize():]
+	plain, err := p.aead.Open(nil, nonce, ciphertext, []byte(p.cookieName))
+	if err != nil {
+		return nil, errors.New("invalid session cookie")
+	}
+
+	var s ProxySession
+	if err := json.Unmarshal(plain, &s); err != nil {
+		return nil, errors.New("malformed session cookie")
+	}
+	if time.Now().Unix() >= s.ExpiresAt {
+		return nil, errors.New("session expired")
+	}
+	if p.revocations != nil {
+		revoked, err := p.revocations.Revoked(r.Context(), s.Issuer, s.Subject, s.SID, time.Unix(s.IssuedAt, 0))
+		if err != nil {
+			return nil, fmt.Errorf("revocation check: %w", err)
+		}
+		if revoked {
+			return nil, errors.New("session revoked")
+		}
+	}
+	return &s, nil
+}
+
+func (p *ProxySessions) Clear(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     p.cookieName,
+		Value:    "",
+		Path:     "/",
+		Domain:   p.domain,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   p.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,173 @@
+package oidcauth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func issueCookie(t *testing.T, p *ProxySessions, s ProxySession) *http.Cookie {
+	t.Helper()
+	w := httptest.NewRecorder()
+	if err := p.Issue(w, s); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Issue() set %d cookies, want 1", len(cookies))
+	}
+	return cookies[0]
+}
+
+func requestWithCookie(c *http.Cookie) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if c != nil {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestProxySessionsSealOpen(t *testing.T) {
+	session := ProxySession{
+		Provider: "default",
+		Issuer:   testIssuer,
+		Subject:  "user-1",
+		SID:      "sid-1",
+		Email:    "alice@example.com",
+		Groups:   []string{"staff"},
+	}
+	p, err := NewProxySessions("secret", "oidc_session", "", time.Hour, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := issueCookie(t, p, session)
+
+	tests := []struct {
+		name    string
+		open    *ProxySessions
+		cookie  func() *http.Cookie
+		wantErr string
+	}{
+		{name: "round trip", open: p, cookie: func() *http.Cookie { return valid }},
+		{name: "no cookie", open: p, cookie: func() *http.Cookie { return nil }, wantErr: "no session cookie"},
+		{
+			name: "tampered",
+			open: p,
+			cookie: func() *http.Cookie {
+				c := *valid
+				b := []byte(c.Value)
+				b[len(b)/2] ^= 1
+				c.Value = string(b)
+				return &c
+			},
+			wantErr: "session cookie",
+		},
+		{
+			name:    "truncated",
+			open:    p,
+			cookie:  func() *http.Cookie { return &http.Cookie{Name: valid.Name, Value: valid.Value[:8]} },
+			wantErr: "session cookie",
+		},
+		{
+			name: "other secret",
+			open: func() *ProxySessions {
+				other, _ := NewProxySessions("other", "oidc_session", "", time.Hour, true, nil)
+				return other
+			}(),
+			cookie:  func() *http.Cookie { return valid },
+			wantErr: "invalid session cookie",
+		},
+		{
+			name: "other cookie name",
+			open: func() *ProxySessions {
+				other, _ := NewProxySessions("secret", "other_session", "", time.Hour, true, nil)
+				return other
+			}(),
+			cookie:  func() *http.Cookie { return &http.Cookie{Name: "other_session", Value: valid.Value} },
+			wantErr: "invalid session cookie",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.open.Verify(requestWithCookie(tt.cookie()))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Verify() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if got.Email != session.Email || got.Subject != session.Subject || got.SID != session.SID || got.IssuedAt == 0 {
+				t.Errorf("Verify() = %+v, want %+v", got, session)
+			}
+		})
+	}
+}
+
+func TestProxySessionsExpired(t *testing.T) {
+	p, err := NewProxySessions("secret", "oidc_session", "", -time.Second, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := issueCookie(t, p, ProxySession{Email: "alice@example.com"})
+	// MaxAge < 0 браузер воспринимает как удаление, поэтому куку передаём вручную
+	if _, err := p.Verify(requestWithCookie(&http.Cookie{Name: c.Name, Value: c.Value})); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("Verify() error = %v, want expired", err)
+	}
+}
+
+func TestProxySessionsRevoked(t *testing.T) {
+	tests := []struct {
+		name          string
+		subject       string
+		sid           string
+		revokeSubject string
+		revokeSID     string
+		issuedAfter   bool
+		want          bool
+	}{
+		{name: "same sid", subject: "user-1", sid: "sid-1", revokeSubject: "user-1", revokeSID: "sid-1", want: true},
+		{name: "sid without subject", subject: "user-1", sid: "sid-1", revokeSID: "sid-1", want: true},
+		{name: "other sid", subject: "user-1", sid: "sid-2", revokeSubject: "user-1", revokeSID: "sid-1"},
+		{name: "all sessions of subject", subject: "user-1", sid: "sid-2", revokeSubject: "user-1", want: true},
+		{name: "other subject", subject: "user-2", revokeSubject: "user-1"},
+		{name: "issued after revocation", subject: "user-1", sid: "sid-1", revokeSubject: "user-1", revokeSID: "sid-1", issuedAfter: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			registry := NewMemorySessionRegistry()
+			p, err := NewProxySessions("secret", "oidc_session", "", time.Hour, true, registry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			session := ProxySession{Issuer: testIssuer, Subject: tt.subject, SID: tt.sid}
+			revoke := func() {
+				if err := registry.Revoke(ctx, testIssuer, tt.revokeSubject, tt.revokeSID, time.Now().Add(time.Hour)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var c *http.Cookie
+			if tt.issuedAfter {
+				revoke()
+				// iat хранится в секундах: выданная в ту же секунду сессия считается отозванной
+				time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+				c = issueCookie(t, p, session)
+			} else {
+				c = issueCookie(t, p, session)
+				revoke()
+			}
+
+			_, err = p.Verify(requestWithCookie(c))
+			if revoked := err != nil; revoked != tt.want {
+				t.Errorf("Verify() error = %v, want revoked %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package oidcauth
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+func newRedirectHosts(externalURL string, allowed []string) map[string]struct{} {
+	hosts := make(map[string]struct{})
+	if u, err := url.Parse(externalURL); err == nil && u.Host != "" {
+		hosts[strings.ToLower(u.Host)] = struct{}{}
+	}
+	for _, h := range allowed {
+		hosts[strings.ToLower(strings.TrimSpace(h))] = struct{}{}
+	}
+	return hosts
+}
+
+// SanitizeRedirect возвращает безопасную цель редиректа после логина:
+// относительный путь в пределах сайта либо абсолютный URL на EXTERNAL_URL
+// или разрешённом хосте. Всё остальное заменяется на "/".
+func (a *OIDCAuthenticator) SanitizeRedirect(target string) string {
+	target = strings.TrimSpace(target)
+	if target == "" || strings.ContainsAny(target, "\\\x00\r\n\t") {
+		return "/"
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || u.Opaque != "" || u.User != nil {
+		return "/"
+	}
+
+	if u.Scheme == "" && u.Host == "" {
+		// Относительный путь: приводим к абсолютному пути на текущем хосте
+		cleaned := path.Clean("/" + u.Path)
+		if strings.HasSuffix(u.Path, "/") && cleaned != "/" {
+			cleaned += "/"
+		}
+		u.Path = cleaned
+		u.RawPath = ""
+		return u.String()
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "/"
+	}
+	if !a.redirectHostAllowed(u) {
+		return "/"
+	}
+	return u.String()
+}
+
+func (a *OIDCAuthenticator) redirectHostAllowed(u *url.URL) bool {
+	host := strings.ToLower(u.Host)
+	hostname := strings.ToLower(u.Hostname())
+	if _, ok := a.redirectHosts[host]; ok {
+		return true
+	}
+	if _, ok := a.redirectHosts[hostname]; ok {
+		return true
+	}
+	// Шаблоны вида *.example.com разрешают любые поддомены
+	for allowed := range a.redirectHosts {
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok && strings.HasSuffix(hostname, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package oidcauth
+
+import "testing"
+
+func TestSanitizeRedirect(t *testing.T) {
+	a := &OIDCAuthenticator{
+		redirectHosts: newRedirectHosts("https://proxy.example.com", []string{"metabase.example.com", "*.apps.example.com"}),
+	}
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{target: "", want: "/"},
+		{target: "/dashboard/1?tab=2", want: "/dashboard/1?tab=2"},
+		{target: "dashboard/", want: "/dashboard/"},
+		{target: "/a/../../etc", want: "/etc"},
+		{target: "https://proxy.example.com/x", want: "https://proxy.example.com/x"},
+		{target: "https://METABASE.example.com/q", want: "https://METABASE.example.com/q"},
+		{target: "https://bi.apps.example.com/", want: "https://bi.apps.example.com/"},
+		{target: "https://apps.example.com/", want: "/"},
+		{target: "https://evil.com/", want: "/"},
+		{target: "https://proxy.example.com.evil.com/", want: "/"},
+		{target: "//evil.com/path", want: "/"},
+		{target: "/\\evil.com", want: "/"},
+		{target: "https://proxy.example.com@evil.com/", want: "/"},
+		{target: "javascript:alert(1)", want: "/"},
+		{target: "ftp://proxy.example.com/", want: "/"},
+		{target: "/ok\r\nSet-Cookie: x=1", want: "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			if got := a.SanitizeRedirect(tt.target); got != tt.want {
+				t.Errorf("SanitizeRedirect(%q) = %q, want %q", tt.target, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package oidcauth
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Session — сессия бэкенда, выданная прокси после логина через провайдера.
+type Session struct {
+	Issuer    string
+	Subject   string
+	SID       string   // sid из ID токена, если провайдер его присылает
+	Cookies   []string // Set-Cookie, которые вернул бэкенд
+	ExpiresAt time.Time
+}
+
+// SessionRegistry запоминает выданные сессии, чтобы их можно было закрыть по back-channel logout.
+type SessionRegistry interface {
+	Add(ctx context.Context, s Session) error
+	// Take удаляет и возвращает сессии субъекта; если sid не пуст — только сессии с этим sid.
+	// Пустой subject означает любой субъект с указанным sid.
+	Take(ctx context.Context, issuer, subject, sid string) ([]Session, error)
+	// Revoke запоминает до until, что сессии субъекта (или только с этим sid), выданные
+	// до текущего момента, закрыты у провайдера. Сессия прокси таких пользователей больше не действует.
+	Revoke(ctx context.Context, issuer, subject, sid string, until time.Time) error
+	RevocationList
+}
+
+// RevocationList сообщает, закрыта ли у провайдера сессия, выданная в issuedAt.
+type RevocationList interface {
+	Revoked(ctx context.Context, issuer, subject, sid string, issuedAt time.Time) (bool, error)
+}
+
+// revocation — запись о закрытой у провайдера сессии.
+type revocation struct {
+	issuer    string
+	subject   string
+	sid       string
+	revokedAt time.Time
+	expiresAt time.Time
+}
+
+// covers сообщает, закрывает ли запись сессию, выданную в issuedAt.
+func (r revocation) covers(issuer, subject, sid string, issuedAt time.Time) bool {
+	if r.issuer != issuer || issuedAt.After(r.revokedAt) {
+		return false
+	}
+	if r.sid != "" {
+		return r.sid == sid && (r.subject == "" || r.subject == subject)
+	}
+	return r.subject == subject
+}
+
+func (s Session) matches(issuer, subject, sid string) bool {
+	if s.Issuer != issuer {
+		return false
+	}
+	if subject != "" && s.Subject != subject {
+		return false
+	}
+	return sid == "" || s.SID == sid
+}
+
+// MemorySessionRegistry хранит сессии в памяти процесса, подходит для одной реплики.
+type MemorySessionRegistry struct {
+	mu          sync.Mutex
+	sessions    []Session
+	revocations []revocation
+	lastSweep   time.Time
+}
+
+func NewMemorySessionRegistry() *MemorySessionRegistry {
+	return &MemorySessionRegistry{}
+}
+
+func (m *MemorySessionRegistry) Add(_ context.Context, s Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.lastSweep) > time.Minute {
+		live := m.sessions[:0]
+		for _, existing := range m.sessions {
+			if now.Before(existing.ExpiresAt) {
+				live = append(live, existing)
+			}
+		}
+		m.sessions = live
+		m.lastSweep = now
+	}
+	m.sessions = append(m.sessions, s)
+	return nil
+}
+
+func (m *MemorySessionRegistry) Take(_ context.Context, issuer, subject, sid string) ([]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var taken []Session
+	rest := m.sessions[:0]
+	for _, s := range m.sessions {
+		switch {
+		case !now.Before(s.ExpiresAt):
+		case s.matches(issuer, subject, sid):
+			taken = append(taken, s)
+		default:
+			rest = append(rest, s)
+		}
+	}
+	m.sessions = rest
+	return taken, nil
+}
+
+func (m *MemorySessionRegistry) Revoke(_ context.Context, issuer, subject, sid string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	live := m.revocations[:0]
+	for _, r := range m.revocations {
+		if now.Before(r.expiresAt) {
+			live = append(live, r)
+		}
+	}
+	m.revocations = append(live, revocation{
+		issuer:    issuer,
+		subject:   subject,
+		sid:       sid,
+		revokedAt: now,
+		expiresAt: until,
+	})
+	return nil
+}
+
+func (m *MemorySessionRegistry) Revoked(_ context.Context, issuer, subject, sid string, issuedAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, r := range m.revocations {
+		if now.Before(r.expiresAt) && r.covers(issuer, subject, sid, issuedAt) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// PostgresSessionRegistry хранит сессии в общей базе, чтобы logout доходил до сессий всех реплик.
+type PostgresSessionRegistry struct {
+	db *gorm.DB
+}
+
+type issuedSession struct {
+	ID        uint      `gorm:"primaryKey"`
+	Issuer    string    `gorm:"column:issuer;not null;index:idx_oidc_sessions_subject"`
+	Subject   string    `gorm:"column:subject;not null;index:idx_oidc_sessions_subject"`
+	SID       string    `gorm:"column:sid;index"`
+	Cookies   string    `gorm:"column:cookies;not null"`
+	ExpiresAt time.Time `gorm:"column:expires_at;not null;index"`
+}
+
+func (issuedSession) TableName() string {
+	return "oidc_sessions"
+}
+
+type revokedSession struct {
+	ID        uint      `gorm:"primaryKey"`
+	Issuer    string    `gorm:"column:issuer;not null;index:idx_oidc_revocations_subject"`
+	Subject   string    `gorm:"column:subject;not null;index:idx_oidc_revocations_subject"`
+	SID       string    `gorm:"column:sid;index"`
+	RevokedAt time.Time `gorm:"column:revoked_at;not null"`
+	ExpiresAt time.Time `gorm:"column:expires_at;not null;index"`
+}
+
+func (revokedSession) TableName() string {
+	return "oidc_revocations"
+}
+
+func NewPostgresSessionRegistry(dsn string) (*PostgresSessionRegistry, error) {
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.AutoMigrate(&issuedSession{}, &revokedSession{}); err != nil {
+		return nil, err
+	}
+	return &PostgresSessionRegistry{db: db}, nil
+}
+
+func (p *PostgresSessionRegistry) Add(ctx context.Context, s Session) error {
+	db := p.db.WithContext(ctx)
+	if err := db.Where("expires_at < ?", time.Now()).Delete(&issuedSession{}).Error; err != nil {
+		return err
+	}
+	// Заголовок Set-Cookie не может содержать перевод строки
+	return db.Create(&issuedSession{
+		Issuer:    s.Issuer,
+		Subject:   s.Subject,
+		SID:       s.SID,
+		Cookies:   strings.Join(s.Cookies, "\n"),
+		ExpiresAt: s.ExpiresAt,
+	}).Error
+}
+
+func (p *PostgresSessionRegistry) Take(ctx context.Context, issuer, subject, sid string) ([]Session, error) {
+	q := p.db.WithContext(ctx).Where("issuer = ? AND expires_at > ?", issuer, time.Now())
+	if subject != "" {
+		q = q.Where("subject = ?", subject)
+	}
+	if sid != "" {
+		q = q.Where("sid = ?", sid)
+	}
+
+	var rows []issuedSession
+	if err := q.Clauses(clause.Returning{}).Delete(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	out := make([]Session, 0, len(rows))
+	for _, row := range rows {
+		out = append(out, Session{
+			Issuer:    row.Issuer,
+			Subject:   row.Subject,
+			SID:       row.SID,
+			Cookies:   strings.Split(row.Cookies, "\n"),
+			ExpiresAt: row.ExpiresAt,
+		})
+	}
+	return out, nil
+}
+
+func (p *PostgresSessionRegistry) Revoke(ctx context.Context, issuer, subject, sid string, until time.Time) error {
+	db := p.db.WithContext(ctx)
+	if err := db.Where("expires_at < ?", time.Now()).Delete(&revokedSession{}).Error; err != nil {
+		return err
+	}
+	return db.Create(&revokedSession{
+		Issuer:    issuer,
+		Subject:   subject,
+		SID:       sid,
+		RevokedAt: time.Now(),
+		ExpiresAt: until,
+	}).Error
+}
+
+func (p *PostgresSessionRegistry) Revoked(ctx context.Context, issuer, subject, sid string, issuedAt time.Time) (bool, error) {
+	var count int64
+	err := p.db.WithContext(ctx).Model(&revokedSession{}).
+		Where("issuer = ? AND revoked_at >= ? AND expires_at > ?", issuer, issuedAt, time.Now()).
+		Where("(sid <> '' AND sid = ? AND (subject = '' OR subject = ?)) OR (sid = '' AND subject = ?)", sid, subject, subject).
+		Count(&count).Error
+	return count > 0, err
+}
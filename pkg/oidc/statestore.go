@@ -0,0 +1,90 @@
+package oidcauth
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// StateStore запоминает уже предъявленные state, чтобы каждый можно было использовать только один раз.
+type StateStore interface {
+	// Consume помечает ключ использованным на ttl. Возвращает false, если ключ уже был использован.
+	Consume(ctx context.Context, key string, ttl time.Duration) (bool, error)
+}
+
+// MemoryStateStore хранит использованные ключи в памяти процесса, подходит для одной реплики.
+// Ключ забывается только после истечения его ttl, иначе поток логинов мог бы вытеснить
+// ещё действующий state и открыть его для повторного использования.
+type MemoryStateStore struct {
+	mu        sync.Mutex
+	items     map[string]time.Time
+	lastSweep time.Time
+}
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{items: make(map[string]time.Time)}
+}
+
+func (s *MemoryStateStore) Consume(_ context.Context, key string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, expiresAt := range s.items {
+			if !now.Before(expiresAt) {
+				delete(s.items, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if expiresAt, ok := s.items[key]; ok && now.Before(expiresAt) {
+		return false, nil
+	}
+	s.items[key] = now.Add(ttl)
+	return true, nil
+}
+
+// PostgresStateStore хранит использованные state в общей базе, чтобы replay отсекался на всех репликах.
+type PostgresStateStore struct {
+	db *gorm.DB
+}
+
+type usedState struct {
+	Key       string    `gorm:"primaryKey;column:key"`
+	ExpiresAt time.Time `gorm:"column:expires_at;not null;index"`
+}
+
+func (usedState) TableName() string {
+	return "oidc_used_states"
+}
+
+func NewPostgresStateStore(dsn string) (*PostgresStateStore, error) {
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.AutoMigrate(&usedState{}); err != nil {
+		return nil, err
+	}
+	return &PostgresStateStore{db: db}, nil
+}
+
+func (s *PostgresStateStore) Consume(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	db := s.db.WithContext(ctx)
+	if err := db.Where("expires_at < ?", now).Delete(&usedState{}).Error; err != nil {
+		return false, err
+	}
+	res := db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&usedState{Key: key, ExpiresAt: now.Add(ttl)})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
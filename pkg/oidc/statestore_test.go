@@ -0,0 +1,58 @@
+package oidcauth
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryStateStoreConsume(t *testing.T) {
+	tests := []struct {
+		name  string
+		prior []string
+		wait  time.Duration
+		key   string
+		want  bool
+	}{
+		{name: "fresh key", key: "a", want: true},
+		{name: "reused key", prior: []string{"a"}, key: "a", want: false},
+		{name: "other key", prior: []string{"a"}, key: "b", want: true},
+		{name: "expired key", prior: []string{"a"}, wait: 20 * time.Millisecond, key: "a", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := NewMemoryStateStore()
+			for _, key := range tt.prior {
+				if _, err := s.Consume(ctx, key, 10*time.Millisecond); err != nil {
+					t.Fatal(err)
+				}
+			}
+			time.Sleep(tt.wait)
+			got, err := s.Consume(ctx, tt.key, 10*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Consume(%q) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+// Поток новых state не должен вытеснять ещё действующие ключи.
+func TestMemoryStateStoreKeepsLiveKeys(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStateStore()
+	if _, err := s.Consume(ctx, "victim", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20000; i++ {
+		if _, err := s.Consume(ctx, time.Duration(i).String(), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fresh, _ := s.Consume(ctx, "victim", time.Hour); fresh {
+		t.Fatal("live key was evicted and accepted again")
+	}
+}
@@ -0,0 +1,44 @@
+package oidcauth
+
+import (
+	"any-oidc-proxy/pkg/metrics"
+	"any-oidc-proxy/pkg/tracing"
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	UserInfoAuto   = "auto"   // запрашивать userinfo, только если в ID токене нет email или имени
+	UserInfoAlways = "always" // запрашивать userinfo при каждом логине
+	UserInfoNever  = "never"
+)
+
+// mergeUserInfo дополняет claims ID токена данными userinfo, не перетирая уже имеющиеся значения.
+func (a *OIDCAuthenticator) mergeUserInfo(ctx context.Context, token *oauth2.Token, subject string, claims map[string]any) error {
+	start := time.Now()
+	spanCtx, span := tracing.Start(ctx, "oidc.UserInfo")
+	info, err := a.provider.UserInfo(spanCtx, oauth2.StaticTokenSource(token))
+	tracing.End(span, err)
+	metrics.ObserveIdP(a.name, "userinfo", start, err)
+	if err != nil {
+		return fmt.Errorf("userinfo request failed: %w", err)
+	}
+	// OIDC Core 5.3.2: sub из userinfo обязан совпадать с sub ID токена
+	if info.Subject != subject {
+		return fmt.Errorf("userinfo subject mismatch")
+	}
+
+	var extra map[string]any
+	if err := info.Claims(&extra); err != nil {
+		return fmt.Errorf("failed to parse userinfo claims: %w", err)
+	}
+	for k, v := range extra {
+		if cur, ok := claims[k]; !ok || cur == nil || cur == "" {
+			claims[k] = v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package oidcauth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// fakeUserInfo — userinfo endpoint провайдера, считающий запросы.
+type fakeUserInfo struct {
+	status int
+	claims map[string]any
+	calls  int
+}
+
+func (f *fakeUserInfo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.calls++
+	if r.Header.Get("Authorization") != "Bearer at" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(f.claims)
+}
+
+// newUserInfoProvider — провайдер, у которого из эндпоинтов есть только userinfo.
+func newUserInfoProvider(t *testing.T, h http.Handler) *oidc.Provider {
+	t.Helper()
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	return (&oidc.ProviderConfig{IssuerURL: testIssuer, UserInfoURL: server.URL}).NewProvider(context.Background())
+}
+
+func TestMergeUserInfo(t *testing.T) {
+	tests := []struct {
+		name     string
+		userinfo *fakeUserInfo
+		claims   map[string]any
+		want     map[string]any
+		wantErr  bool
+	}{
+		{
+			name:     "fills missing",
+			userinfo: &fakeUserInfo{claims: map[string]any{"sub": "user-1", "email": "alice@example.com", "name": "Liddell Alice"}},
+			claims:   map[string]any{"sub": "user-1"},
+			want:     map[string]any{"sub": "user-1", "email": "alice@example.com", "name": "Liddell Alice"},
+		},
+		{
+			name:     "keeps ID token values",
+			userinfo: &fakeUserInfo{claims: map[string]any{"sub": "user-1", "email": "other@example.com", "groups": []any{"dev"}}},
+			claims:   map[string]any{"sub": "user-1", "email": "alice@example.com"},
+			want:     map[string]any{"sub": "user-1", "email": "alice@example.com", "groups": []any{"dev"}},
+		},
+		{
+			name:     "replaces empty values",
+			userinfo: &fakeUserInfo{claims: map[string]any{"sub": "user-1", "email": "alice@example.com", "name": "Liddell Alice"}},
+			claims:   map[string]any{"sub": "user-1", "email": "", "name": nil},
+			want:     map[string]any{"sub": "user-1", "email": "alice@example.com", "name": "Liddell Alice"},
+		},
+		{
+			name:     "subject mismatch",
+			userinfo: &fakeUserInfo{claims: map[string]any{"sub": "user-2", "email": "mallory@example.com"}},
+			claims:   map[string]any{"sub": "user-1"},
+			want:     map[string]any{"sub": "user-1"},
+			wantErr:  true,
+		},
+		{
+			name:     "endpoint failure",
+			userinfo: &fakeUserInfo{status: http.StatusBadGateway},
+			claims:   map[string]any{"sub": "user-1"},
+			want:     map[string]any{"sub": "user-1"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &OIDCAuthenticator{name: "default", provider: newUserInfoProvider(t, tt.userinfo)}
+			token := &oauth2.Token{AccessToken: "at", TokenType: "Bearer"}
+			err := a.mergeUserInfo(context.Background(), token, "user-1", tt.claims)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mergeUserInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(tt.claims, tt.want) {
+				t.Errorf("claims = %v, want %v", tt.claims, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractUserInfoModes(t *testing.T) {
+	signer := newTestSigner(t)
+	complete := map[string]any{"email": "alice@example.com", "name": "Liddell Alice"}
+	noEmail := map[string]any{"name": "Liddell Alice"}
+	userinfo := map[string]any{"sub": "user-1", "email": "alice@corp.example.com", "name": "Other Name"}
+	tests := []struct {
+		name      string
+		mode      string
+		claims    map[string]any
+		status    int
+		wantCalls int
+		wantEmail string
+		wantErr   bool
+	}{
+		{name: "never", mode: UserInfoNever, claims: noEmail, wantErr: true},
+		{name: "auto complete token", mode: UserInfoAuto, claims: complete, wantEmail: "alice@example.com"},
+		{name: "auto incomplete token", mode: UserInfoAuto, claims: noEmail, wantCalls: 1, wantEmail: "alice@corp.example.com"},
+		{name: "auto failure is not fatal", mode: UserInfoAuto, claims: map[string]any{"email": "alice@example.com"}, status: http.StatusBadGateway, wantCalls: 1, wantEmail: "alice@example.com"},
+		{name: "auto failure without email", mode: UserInfoAuto, claims: noEmail, status: http.StatusBadGateway, wantCalls: 1, wantErr: true},
+		{name: "always", mode: UserInfoAlways, claims: complete, wantCalls: 1, wantEmail: "alice@example.com"},
+		{name: "always failure is fatal", mode: UserInfoAlways, claims: complete, status: http.StatusBadGateway, wantCalls: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeUserInfo{status: tt.status, claims: userinfo}
+			a := &OIDCAuthenticator{
+				name:         "default",
+				provider:     newUserInfoProvider(t, fake),
+				verifier:     signer.verifier(false),
+				userInfoMode: tt.mode,
+				claimMapping: DefaultClaimMapping(),
+			}
+			user, _, err := a.extractUserInfo(context.Background(), signedToken(t, signer, tt.claims), testNonce)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractUserInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if fake.calls != tt.wantCalls {
+				t.Errorf("userinfo requested %d times, want %d", fake.calls, tt.wantCalls)
+			}
+			if err == nil && user.Email != tt.wantEmail {
+				t.Errorf("email = %q, want %q", user.Email, tt.wantEmail)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package oidcauth
+
+import (
+	"any-oidc-proxy/pkg/backend"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// userLockWait — сколько ждать, пока закончится вход того же пользователя в соседнем запросе
+const userLockWait = 30 * time.Second
+
+// UserLocks сериализует заведение пользователя и вход в бэкенд для одного пользователя:
+// две вкладки или двойной клик иначе одновременно проходят FindOrCreateUser и смену пароля.
+// Один экземпляр разделяется всеми провайдерами, потому что бэкенд у них общий.
+type UserLocks struct {
+	mu    sync.Mutex
+	locks map[string]*userLock
+}
+
+type userLock struct {
+	sem  chan struct{}
+	refs int
+}
+
+func NewUserLocks() *UserLocks {
+	return &UserLocks{locks: make(map[string]*userLock)}
+}
+
+// userLockKeys возвращает ключи блокировки пользователя в фиксированном порядке: iss и sub
+// сериализуют вход одной учётной записи IdP, даже если email в ней сменился, а email — вход
+// одного человека через разных провайдеров, ведь бэкенды ищут пользователя по email.
+func userLockKeys(user backend.UserData) []string {
+	var keys []string
+	if email := strings.ToLower(strings.TrimSpace(user.Email)); email != "" {
+		keys = append(keys, "email:"+email)
+	}
+	if user.Issuer != "" && user.Subject != "" {
+		keys = append(keys, "sub:"+user.Issuer+"\x00"+user.Subject)
+	}
+	// Один порядок захвата для всех исключает взаимную блокировку
+	sort.Strings(keys)
+	return keys
+}
+
+// Lock захватывает блокировки пользователя и возвращает функцию их снятия. Ждёт не дольше
+// userLockWait и не дольше, чем живёт ctx.
+func (l *UserLocks) Lock(ctx context.Context, user backend.UserData) (func(), error) {
+	timer := time.NewTimer(userLockWait)
+	defer timer.Stop()
+
+	var unlocks []func()
+	unlock := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for _, key := range userLockKeys(user) {
+		u, err := l.lock(ctx, key, timer.C)
+		if err != nil {
+			unlock()
+			if errors.Is(err, errUserLockWait) {
+				return nil, fmt.Errorf("another login of %s is still in progress", user.Email)
+			}
+			return nil, err
+		}
+		unlocks = append(unlocks, u)
+	}
+	return unlock, nil
+}
+
+var errUserLockWait = errors.New("user lock wait exceeded")
+
+func (l *UserLocks) lock(ctx context.Context, key string, timeout <-chan time.Time) (func(), error) {
+	l.mu.Lock()
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &userLock{sem: make(chan struct{}, 1)}
+		l.locks[key] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	release := func() {
+		l.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+
+	select {
+	case lock.sem <- struct{}{}:
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	case <-timeout:
+		release()
+		return nil, errUserLockWait
+	}
+
+	return func() {
+		<-lock.sem
+		release()
+	}, nil
+}
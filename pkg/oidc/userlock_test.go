@@ -0,0 +1,164 @@
+package oidcauth
+
+import (
+	"any-oidc-proxy/pkg/backend"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUserLockKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     backend.UserData
+		conflict bool
+	}{
+		{
+			name:     "same subject, new email",
+			a:        backend.UserData{Issuer: testIssuer, Subject: "u1", Email: "old@example.com"},
+			b:        backend.UserData{Issuer: testIssuer, Subject: "u1", Email: "new@example.com"},
+			conflict: true,
+		},
+		{
+			name:     "same email, other subjects",
+			a:        backend.UserData{Issuer: testIssuer, Subject: "u1", Email: "a@example.com"},
+			b:        backend.UserData{Issuer: testIssuer, Subject: "u2", Email: "a@example.com"},
+			conflict: true,
+		},
+		{
+			name:     "same email at other providers",
+			a:        backend.UserData{Issuer: testIssuer, Subject: "u1", Email: "Alice@Example.com"},
+			b:        backend.UserData{Issuer: "https://other.example.com", Subject: "x9", Email: " alice@example.com"},
+			conflict: true,
+		},
+		{
+			name: "other users",
+			a:    backend.UserData{Issuer: testIssuer, Subject: "u1", Email: "a@example.com"},
+			b:    backend.UserData{Issuer: testIssuer, Subject: "u2", Email: "b@example.com"},
+		},
+		{
+			name: "same subject at other issuers",
+			a:    backend.UserData{Issuer: testIssuer, Subject: "u1"},
+			b:    backend.UserData{Issuer: "https://other.example.com", Subject: "u1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := map[string]bool{}
+			for _, k := range userLockKeys(tt.a) {
+				keys[k] = true
+			}
+			conflict := false
+			for _, k := range userLockKeys(tt.b) {
+				conflict = conflict || keys[k]
+			}
+			if conflict != tt.conflict {
+				t.Errorf("userLockKeys(%+v) and userLockKeys(%+v) conflict = %v, want %v", tt.a, tt.b, conflict, tt.conflict)
+			}
+		})
+	}
+}
+
+func TestUserLocksLock(t *testing.T) {
+	alice := backend.UserData{Issuer: testIssuer, Subject: "alice", Email: "alice@example.com"}
+	bob := backend.UserData{Issuer: testIssuer, Subject: "bob", Email: "bob@example.com"}
+	tests := []struct {
+		name    string
+		held    backend.UserData
+		want    backend.UserData
+		wantErr error
+	}{
+		{name: "other user is not blocked", held: alice, want: bob},
+		{name: "same user waits for the context", held: alice, want: alice, wantErr: context.DeadlineExceeded},
+		{
+			name:    "same email at another provider waits",
+			held:    backend.UserData{Issuer: testIssuer, Subject: "alice", Email: "alice@example.com"},
+			want:    backend.UserData{Issuer: "https://other.example.com", Subject: "a1", Email: "alice@example.com"},
+			wantErr: context.DeadlineExceeded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			locks := NewUserLocks()
+			unlock, err := locks.Lock(context.Background(), tt.held)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer unlock()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			unlock2, err := locks.Lock(ctx, tt.want)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Lock() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				unlock2()
+			}
+		})
+	}
+}
+
+func TestUserLocksRelease(t *testing.T) {
+	locks := NewUserLocks()
+	user := backend.UserData{Email: "alice@example.com"}
+	unlock, err := locks.Lock(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		unlock, err := locks.Lock(context.Background(), user)
+		if err == nil {
+			unlock()
+		}
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("second Lock() did not wait for the first")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("second Lock() was not released")
+	}
+
+	locks.mu.Lock()
+	defer locks.mu.Unlock()
+	if len(locks.locks) != 0 {
+		t.Errorf("%d locks left after release", len(locks.locks))
+	}
+}
+
+// Два входа, делящие оба ключа, берут их в одном порядке и не блокируют друг друга навсегда.
+func TestUserLocksNoDeadlock(t *testing.T) {
+	locks := NewUserLocks()
+	users := []backend.UserData{
+		{Issuer: testIssuer, Subject: "u1", Email: "alice@example.com"},
+		{Issuer: testIssuer, Subject: "u1", Email: "bob@example.com"},
+		{Issuer: "https://other.example.com", Subject: "u2", Email: "bob@example.com"},
+	}
+	done := make(chan error)
+	for i := 0; i < 30; i++ {
+		go func(user backend.UserData) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			unlock, err := locks.Lock(ctx, user)
+			if err == nil {
+				unlock()
+			}
+			done <- err
+		}(users[i%len(users)])
+	}
+	for i := 0; i < 30; i++ {
+		if err := <-done; err != nil {
+			t.Fatalf("Lock() error = %v", err)
+		}
+	}
+}
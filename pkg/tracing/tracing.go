@@ -0,0 +1,86 @@
+// Package tracing — трассировка OpenTelemetry: спаны логина, вызовов бэкендов и проксируемых запросов.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "any-oidc-proxy"
+	// serverSpanName — имя серверного спана. Путь в имя не попадает: он остаётся в атрибутах,
+	// а имена спанов должны быть ограниченным набором, иначе бэкенд трасс не сгруппирует запросы.
+	serverSpanName = "http.server"
+)
+
+// NewExporter создаёт экспортёр по имени: otlp — OTLP/HTTP с адресом, заголовками и TLS из
+// стандартных переменных OTEL_EXPORTER_OTLP_*, stdout — вывод спанов в stdout для отладки.
+func NewExporter(ctx context.Context, name string) (sdktrace.SpanExporter, error) {
+	switch name {
+	case "otlp":
+		return otlptracehttp.New(ctx)
+	case "stdout":
+		return stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown exporter %q (want otlp or stdout)", name)
+	}
+}
+
+// Init регистрирует глобальный TracerProvider с экспортёром exporter и W3C-пропагацию
+// (traceparent, baggage). Для проверки без коллектора подойдёт tracetest.NewInMemoryExporter.
+// ForceFlush провайдера досылает накопленные спаны, Shutdown — ещё и останавливает экспорт.
+func Init(exporter sdktrace.SpanExporter, serviceName string) (*sdktrace.TracerProvider, error) {
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(serviceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	return provider, nil
+}
+
+// Start открывает спан. Пока Init не вызван, спаны ничего не стоят и никуда не уходят.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End закрывает спан, отмечая в нём ошибку, если она есть.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Transport создаёт клиентский спан на каждый исходящий запрос и передаёт traceparent дальше.
+func Transport(next http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(next)
+}
+
+// Handler продолжает трассу из входящего traceparent и открывает серверный спан на запрос.
+func Handler(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, serverSpanName)
+}
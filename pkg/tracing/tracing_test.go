@@ -0,0 +1,73 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestHandler(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider, err := Init(exporter, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := Start(r.Context(), "oidc.StartAuth")
+		End(span, errors.New("idp unavailable"))
+	}))
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	r := httptest.NewRequest(http.MethodGet, "/users/42", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if err := provider.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	// спаны уходят в порядке завершения: вложенный раньше серверного
+	inner, server := spans[0], spans[1]
+	if server.Name != serverSpanName {
+		t.Errorf("server span name = %q, want %q", server.Name, serverSpanName)
+	}
+	if got := server.SpanContext.TraceID().String(); got != traceID {
+		t.Errorf("trace id = %s, want %s from traceparent", got, traceID)
+	}
+	if inner.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Errorf("inner span parent = %s, want server span %s", inner.Parent.SpanID(), server.SpanContext.SpanID())
+	}
+	if inner.Status.Code != codes.Error {
+		t.Errorf("inner span status = %v, want error", inner.Status.Code)
+	}
+}
+
+func TestNewExporter(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: "otlp"},
+		{name: "stdout"},
+		{name: "jaeger", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter, err := NewExporter(context.Background(), tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewExporter(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if exporter != nil {
+				_ = exporter.Shutdown(context.Background())
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"any-oidc-proxy/pkg/backend"
+	"any-oidc-proxy/pkg/logging"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// reloginReuse — сколько свежие куки отдаются параллельным запросам, пришедшим со старой сессией
+const reloginReuse = 30 * time.Second
+
+// reloginCall — один повторный вход; параллельные запросы того же пользователя ждут его результата.
+type reloginCall struct {
+	done    chan struct{}
+	cookies []string
+	err     error
+	at      time.Time
+}
+
+type reloginGroup struct {
+	mu    sync.Mutex
+	calls map[string]*reloginCall
+}
+
+func newReloginGroup() *reloginGroup {
+	return &reloginGroup{calls: make(map[string]*reloginCall)}
+}
+
+func (g *reloginGroup) do(key string, fn func() ([]string, error)) ([]string, error) {
+	g.mu.Lock()
+	now := time.Now()
+	for k, c := range g.calls {
+		select {
+		case <-c.done:
+			if now.Sub(c.at) > reloginReuse {
+				delete(g.calls, k)
+			}
+		default:
+		}
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.cookies, c.err
+	}
+	c := &reloginCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.cookies, c.err = fn()
+	c.at = time.Now()
+	if c.err != nil {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+	}
+	close(c.done)
+	return c.cookies, c.err
+}
+
+// relogin восстанавливает истёкшую сессию бэкенда по сессии прокси. Переход браузера
+// перенаправляется на тот же адрес со свежими куками, идемпотентный запрос повторяется,
+// остальные получают исходный ответ вместе со свежими куками. Возвращает false, если
+// ответ не про истёкшую сессию или восстановить её нельзя.
+func (a *App) relogin(resp *http.Response, transport http.RoundTripper) bool {
+	detector, ok := a.backend.(backend.SessionExpiryDetector)
+	if !ok || !detector.SessionExpired(resp) {
+		return false
+	}
+	req := resp.Request
+	session, err := a.proxySessions.Verify(req)
+	if err != nil {
+		return false
+	}
+	oidcAuth := a.provider(session.Provider)
+	if oidcAuth == nil {
+		return false
+	}
+
+	cookies, err := a.relogins.do(session.Provider+"\x00"+session.Subject, func() ([]string, error) {
+		// Вход переживает отмену запроса, которым он начат: его ждут и другие запросы
+		ctx := logging.WithRequestID(context.Background(), logging.RequestID(req.Context()))
+		ctx, cancel := context.WithTimeout(ctx, a.config.HTTPRequestTimeoutBackend)
+		defer cancel()
+		return oidcAuth.Relogin(ctx, session)
+	})
+	if err != nil {
+		logging.FromContext(req.Context()).Warnf("backend relogin for %s failed: %v", session.Email, err)
+		return false
+	}
+	setCookies := a.cookieManager.RewriteCookies(req, cookies)
+
+	switch {
+	case isNavigation(req):
+		resp.Body.Close()
+		*resp = http.Response{
+			Status:     http.StatusText(http.StatusFound),
+			StatusCode: http.StatusFound,
+			Proto:      resp.Proto,
+			ProtoMajor: resp.ProtoMajor,
+			ProtoMinor: resp.ProtoMinor,
+			Header:     http.Header{"Location": {req.URL.RequestURI()}},
+			Body:       http.NoBody,
+			Request:    req,
+		}
+	case retryable(req):
+		retry := req.Clone(req.Context())
+		replaceCookies(retry, cookies)
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				break
+			}
+		}
+		retried, err := transport.RoundTrip(retry)
+		if err != nil {
+			logging.FromContext(req.Context()).Warnf("retry after backend relogin failed: %v", err)
+			break
+		}
+		resp.Body.Close()
+		*resp = *retried
+	}
+
+	for _, c := range setCookies {
+		resp.Header.Add("Set-Cookie", c)
+	}
+	return true
+}
+
+// retryable — запрос можно безопасно отправить повторно. POST и PATCH не повторяются
+// даже без тела: они не идемпотентны.
+func retryable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// replaceCookies заменяет в запросе куки, которые бэкенд только что выдал заново.
+func replaceCookies(r *http.Request, setCookies []string) {
+	fresh := make(map[string]string)
+	for _, line := range setCookies {
+		if c, err := http.ParseSetCookie(line); err == nil {
+			fresh[c.Name] = c.Value
+		}
+	}
+	old := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range old {
+		if _, ok := fresh[c.Name]; !ok {
+			r.AddCookie(c)
+		}
+	}
+	for name, value := range fresh {
+		r.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+}